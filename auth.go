@@ -0,0 +1,192 @@
+package dexec
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	types "github.com/docker/docker/api/types"
+)
+
+// dockerHub is the name used for the registry of Docker Hub.
+const dockerHub = "docker.io"
+
+// dockerHubServer is the key of Docker Hub in config.json and the server URL
+// passed to the credential helpers for it.
+const dockerHubServer = "https://index.docker.io/v1/"
+
+// AuthResolver resolves the credentials used to pull images from a registry.
+type AuthResolver interface {
+	// ResolveAuth returns the credentials for the registry host (such as
+	// "docker.io" or "registry.example.com:5000"), or nil if there are none.
+	ResolveAuth(registry string) (*types.AuthConfig, error)
+}
+
+// StaticAuth is an AuthResolver of credentials keyed by registry host. Docker
+// Hub can be referred to as "docker.io".
+type StaticAuth map[string]types.AuthConfig
+
+// ResolveAuth implements AuthResolver.
+func (a StaticAuth) ResolveAuth(registry string) (*types.AuthConfig, error) {
+	registry = normalizeRegistry(registry)
+	for k, v := range a {
+		if normalizeRegistry(k) == registry {
+			auth := v
+			return &auth, nil
+		}
+	}
+	return nil, nil
+}
+
+// DockerConfig is the registry configuration read from the config.json file
+// of the Docker CLI. It resolves credentials from the credential helpers
+// configured in it, or from its "auths" entries.
+type DockerConfig struct {
+	Auths       map[string]types.AuthConfig `json:"auths"`
+	CredsStore  string                      `json:"credsStore,omitempty"`
+	CredHelpers map[string]string           `json:"credHelpers,omitempty"`
+}
+
+// LoadDockerConfig reads the config.json file at path. If path is empty, the
+// file in $DOCKER_CONFIG or in ~/.docker is read. A missing file results in
+// an empty configuration.
+func LoadDockerConfig(path string) (*DockerConfig, error) {
+	if path == "" {
+		dir := os.Getenv("DOCKER_CONFIG")
+		if dir == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, fmt.Errorf("dexec: cannot locate docker config: %w", err)
+			}
+			dir = filepath.Join(home, ".docker")
+		}
+		path = filepath.Join(dir, "config.json")
+	}
+
+	cfg := &DockerConfig{}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("dexec: cannot read docker config: %w", err)
+	}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("dexec: cannot parse docker config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// ResolveAuth implements AuthResolver. A credential helper configured for the
+// registry in "credHelpers" takes precedence over the one in "credsStore".
+// The "auths" entries are used if there is no helper or it has no
+// credentials for the registry.
+func (c *DockerConfig) ResolveAuth(registry string) (*types.AuthConfig, error) {
+	registry = normalizeRegistry(registry)
+	server := registry
+	if registry == dockerHub {
+		server = dockerHubServer
+	}
+
+	if helper := c.helperFor(registry); helper != "" {
+		auth, err := helperAuth(helper, server)
+		if err != nil || auth != nil {
+			return auth, err
+		}
+	}
+
+	for k, v := range c.Auths {
+		if normalizeRegistry(k) != registry {
+			continue
+		}
+		auth := v
+		if auth.Auth != "" {
+			b, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("dexec: invalid auth for %s in docker config: %w", k, err)
+			}
+			user, pass, ok := strings.Cut(string(b), ":")
+			if !ok {
+				return nil, fmt.Errorf("dexec: invalid auth for %s in docker config", k)
+			}
+			auth.Username, auth.Password, auth.Auth = user, pass, ""
+		}
+		auth.ServerAddress = server
+		return &auth, nil
+	}
+	return nil, nil
+}
+
+func (c *DockerConfig) helperFor(registry string) string {
+	for k, v := range c.CredHelpers {
+		if normalizeRegistry(k) == registry {
+			return v
+		}
+	}
+	return c.CredsStore
+}
+
+// helperAuth gets the credentials for the server from the credential helper
+// docker-credential-<helper> found in $PATH.
+func helperAuth(helper, server string) (*types.AuthConfig, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	out, err := cmd.Output()
+	if err != nil {
+		// helpers report missing credentials on stdout
+		if bytes.Contains(out, []byte("credentials not found")) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("dexec: credential helper %s failed: %w: %s", helper, err, bytes.TrimSpace(out))
+	}
+
+	var creds struct {
+		ServerURL string
+		Username  string
+		Secret    string
+	}
+	if err := json.Unmarshal(out, &creds); err != nil {
+		return nil, fmt.Errorf("dexec: invalid output from credential helper %s: %w", helper, err)
+	}
+	auth := &types.AuthConfig{ServerAddress: server}
+	if creds.Username == "<token>" {
+		auth.IdentityToken = creds.Secret
+	} else {
+		auth.Username, auth.Password = creds.Username, creds.Secret
+	}
+	return auth, nil
+}
+
+// normalizeRegistry returns the host of a registry address, which may be a
+// URL as used in config.json.
+func normalizeRegistry(s string) string {
+	if i := strings.Index(s, "://"); i >= 0 {
+		s = s[i+3:]
+	}
+	if i := strings.Index(s, "/"); i >= 0 {
+		s = s[:i]
+	}
+	switch s {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return dockerHub
+	}
+	return s
+}
+
+// registryHost returns the host of the registry an image reference points to.
+func registryHost(ref string) string {
+	i := strings.Index(ref, "/")
+	if i < 0 {
+		return dockerHub
+	}
+	host := ref[:i]
+	if !strings.ContainsAny(host, ".:") && host != "localhost" {
+		return dockerHub
+	}
+	return normalizeRegistry(host)
+}
@@ -0,0 +1,156 @@
+package dexec_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	types "github.com/docker/docker/api/types"
+	dexec "github.com/silentred/go-dexec"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&AuthTestSuite{})
+
+// AuthTestSuite does not need a Docker engine.
+type AuthTestSuite struct {
+	dir  string
+	path string
+}
+
+func (s *AuthTestSuite) SetUpTest(c *C) {
+	s.dir = c.MkDir()
+	s.path = os.Getenv("PATH")
+
+	// fake credential helper answering for registry.example.com only
+	helper := `#!/bin/sh
+read server
+case "$server" in
+registry.example.com) echo '{"ServerURL":"registry.example.com","Username":"helper-user","Secret":"helper-pass"}' ;;
+token.example.com) echo '{"ServerURL":"token.example.com","Username":"<token>","Secret":"tok"}' ;;
+broken.example.com) echo 'boom'; exit 2 ;;
+*) echo 'credentials not found in native keychain'; exit 1 ;;
+esac
+`
+	err := ioutil.WriteFile(filepath.Join(s.dir, "docker-credential-fake"), []byte(helper), 0755)
+	c.Assert(err, IsNil)
+	os.Setenv("PATH", s.dir+string(os.PathListSeparator)+s.path)
+}
+
+func (s *AuthTestSuite) TearDownTest(c *C) {
+	os.Setenv("PATH", s.path)
+}
+
+func (s *AuthTestSuite) writeConfig(c *C, content string) string {
+	p := filepath.Join(s.dir, "config.json")
+	c.Assert(ioutil.WriteFile(p, []byte(content), 0600), IsNil)
+	return p
+}
+
+func (s *AuthTestSuite) TestMissingConfigIsEmpty(c *C) {
+	cfg, err := dexec.LoadDockerConfig(filepath.Join(s.dir, "nope.json"))
+	c.Assert(err, IsNil)
+	auth, err := cfg.ResolveAuth("docker.io")
+	c.Assert(err, IsNil)
+	c.Assert(auth, IsNil)
+}
+
+func (s *AuthTestSuite) TestDockerConfigFromEnv(c *C) {
+	s.writeConfig(c, `{"auths":{"r.example.com":{"auth":"dTpw"}}}`)
+	defer os.Setenv("DOCKER_CONFIG", os.Getenv("DOCKER_CONFIG"))
+	os.Setenv("DOCKER_CONFIG", s.dir)
+
+	cfg, err := dexec.LoadDockerConfig("")
+	c.Assert(err, IsNil)
+	auth, err := cfg.ResolveAuth("r.example.com")
+	c.Assert(err, IsNil)
+	c.Assert(auth.Username, Equals, "u")
+	c.Assert(auth.Password, Equals, "p")
+}
+
+func (s *AuthTestSuite) TestAuthsEntries(c *C) {
+	cfg, err := dexec.LoadDockerConfig(s.writeConfig(c, `{"auths":{
+		"https://index.docker.io/v1/": {"auth": "aHViOnNlY3JldA=="},
+		"https://registry.example.com:5000/v2/": {"username": "u", "password": "p"}
+	}}`))
+	c.Assert(err, IsNil)
+
+	auth, err := cfg.ResolveAuth("docker.io")
+	c.Assert(err, IsNil)
+	c.Assert(auth, NotNil)
+	c.Assert(auth.Username, Equals, "hub")
+	c.Assert(auth.Password, Equals, "secret")
+	c.Assert(auth.ServerAddress, Equals, "https://index.docker.io/v1/")
+
+	auth, err = cfg.ResolveAuth("registry.example.com:5000")
+	c.Assert(err, IsNil)
+	c.Assert(auth, NotNil)
+	c.Assert(auth.Username, Equals, "u")
+	c.Assert(auth.Password, Equals, "p")
+
+	auth, err = cfg.ResolveAuth("other.example.com")
+	c.Assert(err, IsNil)
+	c.Assert(auth, IsNil)
+}
+
+func (s *AuthTestSuite) TestCredHelpers(c *C) {
+	cfg, err := dexec.LoadDockerConfig(s.writeConfig(c, `{
+		"auths": {"registry.example.com": {}, "fallback.example.com": {"auth": "Zjpi"}},
+		"credHelpers": {
+			"registry.example.com": "fake",
+			"token.example.com": "fake",
+			"fallback.example.com": "fake",
+			"broken.example.com": "fake"
+		}
+	}`))
+	c.Assert(err, IsNil)
+
+	auth, err := cfg.ResolveAuth("registry.example.com")
+	c.Assert(err, IsNil)
+	c.Assert(*auth, DeepEquals, types.AuthConfig{
+		Username:      "helper-user",
+		Password:      "helper-pass",
+		ServerAddress: "registry.example.com",
+	})
+
+	auth, err = cfg.ResolveAuth("token.example.com")
+	c.Assert(err, IsNil)
+	c.Assert(auth.IdentityToken, Equals, "tok")
+	c.Assert(auth.Username, Equals, "")
+
+	// not known to the helper, falls back to auths
+	auth, err = cfg.ResolveAuth("fallback.example.com")
+	c.Assert(err, IsNil)
+	c.Assert(auth.Username, Equals, "f")
+
+	_, err = cfg.ResolveAuth("broken.example.com")
+	c.Assert(err, ErrorMatches, "dexec: credential helper fake failed: .*boom")
+}
+
+func (s *AuthTestSuite) TestCredsStore(c *C) {
+	cfg, err := dexec.LoadDockerConfig(s.writeConfig(c, `{"credsStore": "fake"}`))
+	c.Assert(err, IsNil)
+	auth, err := cfg.ResolveAuth("registry.example.com")
+	c.Assert(err, IsNil)
+	c.Assert(auth.Username, Equals, "helper-user")
+
+	auth, err = cfg.ResolveAuth("docker.io")
+	c.Assert(err, IsNil)
+	c.Assert(auth, IsNil)
+}
+
+func (s *AuthTestSuite) TestStaticAuth(c *C) {
+	a := dexec.StaticAuth{
+		"docker.io":                 {Username: "hub"},
+		"https://r.example.com/v2/": {Username: "r"},
+	}
+	auth, err := a.ResolveAuth("index.docker.io")
+	c.Assert(err, IsNil)
+	c.Assert(auth.Username, Equals, "hub")
+	auth, err = a.ResolveAuth("r.example.com")
+	c.Assert(err, IsNil)
+	c.Assert(auth.Username, Equals, "r")
+	auth, err = a.ResolveAuth("x.example.com")
+	c.Assert(err, IsNil)
+	c.Assert(auth, IsNil)
+}
@@ -0,0 +1,221 @@
+package dexec
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+
+	types "github.com/docker/docker/api/types"
+	docker "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+// DefaultBuildRepo is the repository of the images built by BuildImage if
+// BuildOption.Repo is empty.
+const DefaultBuildRepo = "dexec-build"
+
+// buildDockerfile is the name of the Dockerfile in the build context, chosen
+// not to collide with a Dockerfile among the context files.
+const buildDockerfile = ".dexec.Dockerfile"
+
+// BuildOption describes an image built by BuildImage.
+type BuildOption struct {
+	// Dockerfile is the content of the Dockerfile.
+	Dockerfile string
+
+	// FS and Files are the files of the build context. Files are added to
+	// the files of FS with mode 0644, replacing the ones with the same path.
+	FS    fs.FS
+	Files map[string][]byte
+
+	// Repo is the repository the image is tagged in. The tag is derived from
+	// the content of the build. Defaults to DefaultBuildRepo.
+	Repo string
+
+	BuildArgs map[string]*string
+	Labels    map[string]string
+
+	// PullParent always attempts to pull a newer version of the base image.
+	PullParent bool
+
+	// NoCache builds the image even if an image with the same content
+	// exists, without using the build cache of the engine.
+	NoCache bool
+
+	// Output, if not nil, receives the output of the build.
+	Output io.Writer
+}
+
+type buildFile struct {
+	data []byte
+	mode fs.FileMode
+}
+
+// BuildImage builds an image from an in-memory Dockerfile and build context,
+// and returns a reference to it that can be used as the image of a container.
+//
+// The image is tagged with a hash of the content of the build, so the build is
+// skipped if an image with the same content was already built on the engine,
+// unless NoCache is set.
+func (d Docker) BuildImage(ctx context.Context, opt BuildOption) (string, error) {
+	files, err := buildFiles(opt)
+	if err != nil {
+		return "", &PhaseError{Phase: PhaseBuild, Err: err}
+	}
+	repo := opt.Repo
+	if repo == "" {
+		repo = DefaultBuildRepo
+	}
+	ref := repo + ":" + buildHash(opt, files)
+
+	if !opt.NoCache {
+		_, _, err := d.Client.ImageInspectWithRaw(ctx, ref)
+		if err == nil {
+			return ref, nil
+		}
+		if !docker.IsErrNotFound(err) {
+			return "", &PhaseError{Phase: PhaseBuild, Err: err}
+		}
+	}
+
+	buildCtx, err := buildContext(opt.Dockerfile, files)
+	if err != nil {
+		return "", &PhaseError{Phase: PhaseBuild, Err: err}
+	}
+	resp, err := d.Client.ImageBuild(ctx, buildCtx, types.ImageBuildOptions{
+		Tags:        []string{ref},
+		Dockerfile:  buildDockerfile,
+		BuildArgs:   opt.BuildArgs,
+		Labels:      opt.Labels,
+		PullParent:  opt.PullParent,
+		NoCache:     opt.NoCache,
+		Remove:      true,
+		ForceRemove: true,
+	})
+	if err != nil {
+		return "", &PhaseError{Phase: PhaseBuild, Err: err}
+	}
+	defer resp.Body.Close()
+
+	// like pulls, the build runs as long as the stream is read
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := dec.Decode(&msg); err == io.EOF {
+			return ref, nil
+		} else if err != nil {
+			return "", &PhaseError{Phase: PhaseBuild, Err: err}
+		}
+		if msg.Error != nil {
+			return "", &PhaseError{Phase: PhaseBuild, Err: msg.Error}
+		}
+		if opt.Output == nil {
+			continue
+		}
+		if msg.Stream != "" {
+			io.WriteString(opt.Output, msg.Stream)
+		} else if msg.Status != "" {
+			fmt.Fprintln(opt.Output, msg.Status)
+		}
+	}
+}
+
+// buildFiles collects the files of the build context.
+func buildFiles(opt BuildOption) (map[string]buildFile, error) {
+	files := make(map[string]buildFile)
+	if opt.FS != nil {
+		err := fs.WalkDir(opt.FS, ".", func(p string, de fs.DirEntry, err error) error {
+			if err != nil || de.IsDir() {
+				return err
+			}
+			info, err := de.Info()
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return fmt.Errorf("dexec: %s is not a regular file", p)
+			}
+			b, err := fs.ReadFile(opt.FS, p)
+			if err != nil {
+				return err
+			}
+			files[p] = buildFile{data: b, mode: info.Mode().Perm()}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for p, b := range opt.Files {
+		files[p] = buildFile{data: b, mode: 0644}
+	}
+	return files, nil
+}
+
+// buildHash hashes everything that determines the built image.
+func buildHash(opt BuildOption, files map[string]buildFile) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "dockerfile %d\n%s\n", len(opt.Dockerfile), opt.Dockerfile)
+	for _, p := range sortedKeys(files) {
+		f := files[p]
+		fmt.Fprintf(h, "file %q %o %d\n", p, f.mode, len(f.data))
+		h.Write(f.data)
+	}
+	for _, k := range sortedKeys(opt.BuildArgs) {
+		if v := opt.BuildArgs[k]; v != nil {
+			fmt.Fprintf(h, "arg %q=%q\n", k, *v)
+		} else {
+			fmt.Fprintf(h, "arg %q\n", k)
+		}
+	}
+	for _, k := range sortedKeys(opt.Labels) {
+		fmt.Fprintf(h, "label %q=%q\n", k, opt.Labels[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// buildContext returns the build context as a tar archive.
+func buildContext(dockerfile string, files map[string]buildFile) (io.Reader, error) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	write := func(name string, f buildFile) error {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     int64(f.mode),
+			Size:     int64(len(f.data)),
+			Typeflag: tar.TypeReg,
+		}); err != nil {
+			return err
+		}
+		_, err := tw.Write(f.data)
+		return err
+	}
+	if err := write(buildDockerfile, buildFile{data: []byte(dockerfile), mode: 0644}); err != nil {
+		return nil, err
+	}
+	for _, p := range sortedKeys(files) {
+		if err := write(p, files[p]); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
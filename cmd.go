@@ -2,17 +2,25 @@ package dexec
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
 
-	docker "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
 )
 
 // Docker contains connection to Docker API.
-// Use github.com/fsouza/go-dockerclient to initialize *docker.Client.
+// Use github.com/docker/docker/client to initialize a *client.Client, or
+// package dexectest for an in-memory engine.
 type Docker struct {
-	*docker.Client
+	Client
 }
 
 // Command returns the Cmd struct to execute the named program with given
@@ -20,9 +28,32 @@ type Docker struct {
 //
 // For each new Cmd, you should create a new instance for "method" argument.
 func (d Docker) Command(method Execution, name string, arg ...string) *Cmd {
-	return &Cmd{Method: method, Path: name, Args: arg, docker: d}
+	cmd := &Cmd{Method: method, Path: name, Args: arg, docker: d}
+	cmd.Cancel = func() error {
+		return cmd.Process.Stop(cmd.stopTimeout())
+	}
+	return cmd
+}
+
+// CommandContext is like Command but includes a context.
+//
+// The provided context is used to abort the Docker API calls made while
+// starting the command, and to call Cmd.Cancel if the context becomes done
+// before the command completes on its own. By default, the container is sent
+// SIGTERM first and SIGKILL after Cmd.StopTimeout. The error returned by Wait
+// then satisfies errors.Is(err, ctx.Err()), whatever the exit status.
+func (d Docker) CommandContext(ctx context.Context, method Execution, name string, arg ...string) *Cmd {
+	if ctx == nil {
+		panic("nil Context")
+	}
+	cmd := d.Command(method, name, arg...)
+	cmd.ctx = ctx
+	return cmd
 }
 
+// DefaultStopTimeout is the grace period used when Cmd.StopTimeout is zero.
+const DefaultStopTimeout = 10 * time.Second
+
 // Cmd represents an external command being prepared or run.
 //
 // A Cmd cannot be reused after calling its Run, Output or CombinedOutput
@@ -62,26 +93,130 @@ type Cmd struct {
 	Stdout io.Writer
 	Stderr io.Writer
 
+	// Inputs are copied into the container after it is created and before
+	// the command starts. The execution strategy must implement FileCopier.
+	Inputs []Input
+
+	// Outputs are copied out of the container after the command exits,
+	// regardless of its exit code, and before the container is removed.
+	// The execution strategy must implement FileCopier.
+	Outputs []Output
+
+	// ReportChanges makes Wait inspect the changes made to the filesystem
+	// of the container, reported by ProcessState.Changes. The execution
+	// strategy must implement Differ.
+	ReportChanges bool
+
+	// ChangesArchive, if not nil, receives the added and modified files of
+	// the container as a tar stream, named with their paths relative to the
+	// root. It requires ReportChanges and an execution strategy that
+	// implements FileCopier as well.
+	ChangesArchive io.Writer
+
+	// Process is the underlying process, once started.
+	Process *Process
+
+	// ProcessState contains information about an exited command,
+	// available after a call to Wait or Run.
+	ProcessState *ProcessState
+
+	// Cancel is called when the context passed to CommandContext is done or
+	// Timeouts.Run elapses before the command exits. By default, it stops
+	// the container with Process.Stop and StopTimeout. A custom Cancel may
+	// for instance send SIGINT with Process.Signal instead. If Cancel is nil,
+	// nothing happens immediately but WaitDelay still takes effect.
+	//
+	// If the command exits with a success status after Cancel is called, and
+	// Cancel does not return an error wrapping os.ErrProcessDone, Wait
+	// returns either an error wrapping the one returned by Cancel, or the
+	// error of the context. If the command exits with a non-success status,
+	// Wait returns the *ExitError as usual, wrapping that error in its Err
+	// field.
+	Cancel func() error
+
+	// StopTimeout is the time given to the container to exit after SIGTERM
+	// by the default Cancel, before it is killed with SIGKILL. If zero,
+	// DefaultStopTimeout is used.
+	StopTimeout time.Duration
+
+	// Timeouts bounds the duration of the phases of the command.
+	Timeouts Timeouts
+
+	// WaitDelay bounds the time Wait spends on a command that fails to exit
+	// after Cancel is called, and on the output of a command that exits but
+	// leaves it open, e.g. to a background process. The delay starts when
+	// Cancel is called or when the command exits, whichever occurs first.
+	//
+	// Once it elapses, a command that has not exited is killed, and the
+	// copying of its output is abandoned. If no Cancel call occurred and the
+	// command otherwise succeeded, Wait then returns ErrWaitDelay. If zero,
+	// Wait copies the output until it is drained.
+	WaitDelay time.Duration
+
 	docker         Docker
+	ctx            context.Context
+	runCtx         context.Context
+	cancelRun      context.CancelFunc
 	started        bool
+	waited         bool
 	closeAfterWait []io.Closer
+	streams        *Streams
+	stderrTail     *prefixSuffixSaver
+	stdout, stderr *gatedWriter
+	copyDone       chan error
+	exited         chan struct{} // closed when Execution.Wait returns
+	waitDone       chan struct{}
+	ctxErr         chan error
+
+	mu         sync.Mutex // guards the fields below
+	drained    bool       // the output of the command is drained
+	stdinErr   error
+	stdinKill  chan struct{} // closed once copyStdin killed the command
+	exitSeen   bool          // Wait saw the exit, copyStdin no longer kills
+	canceledAt time.Time
+}
+
+// Timeouts bounds the duration of the phases of a command. A zero value
+// leaves the phase bounded only by the context passed to CommandContext.
+type Timeouts struct {
+	// Pull bounds pulling the image, which may legitimately take minutes.
+	Pull time.Duration
+
+	// Create, Attach and Start bound the corresponding Execution calls,
+	// which should take seconds.
+	Create time.Duration
+	Attach time.Duration
+	Start  time.Duration
+
+	// Run bounds the time from the start of the command until it exits.
+	// Once it elapses, the command is canceled as if the context passed to
+	// CommandContext was done, and the error returned by Wait wraps
+	// context.DeadlineExceeded.
+	Run time.Duration
 }
 
 // Start starts the specified command but does not wait for it to complete.
 func (c *Cmd) Start() error {
 	if c.Dir != "" {
-		if err := c.Method.setDir(c.Dir); err != nil {
+		if err := c.Method.SetDir(c.Dir); err != nil {
 			return err
 		}
 	}
 	if c.Env != nil {
-		if err := c.Method.setEnv(c.Env); err != nil {
+		if err := c.Method.SetEnv(c.Env); err != nil {
 			return err
 		}
 	}
 
 	if c.started {
-		return errors.New("dexec: already started")
+		return ErrAlreadyStarted
+	}
+	if c.ctx != nil {
+		select {
+		case <-c.ctx.Done():
+			return c.ctx.Err()
+		default:
+		}
 	}
 	c.started = true
 
@@ -94,18 +229,138 @@ func (c *Cmd) Start() error {
 	if c.Stderr == nil {
 		c.Stderr = ioutil.Discard
 	}
+	c.stderrTail = &prefixSuffixSaver{N: stderrTailSize}
 
+	if p, ok := c.Method.(Puller); ok {
+		if err := c.phase(c.Timeouts.Pull, func(ctx context.Context) error {
+			return p.Pull(ctx, c.docker)
+		}); err != nil {
+			return err
+		}
+	}
 	cmd := append([]string{c.Path}, c.Args...)
-	if err := c.Method.create(c.docker, cmd); err != nil {
+	if err := c.phase(c.Timeouts.Create, func(ctx context.Context) error {
+		return c.Method.Create(ctx, c.docker, cmd)
+	}); err != nil {
 		return err
 	}
-	if err := c.Method.run(c.docker, c.Stdin, c.Stdout, c.Stderr); err != nil {
+	if err := c.copyInputs(); err != nil {
+		c.Method.Cleanup(context.Background(), c.docker)
 		return err
 	}
+	// attach before starting, so that no output is missed
+	var streams *Streams
+	if err := c.phase(c.Timeouts.Attach, func(ctx context.Context) (err error) {
+		streams, err = c.Method.Attach(ctx, c.docker)
+		return err
+	}); err != nil {
+		c.Method.Cleanup(context.Background(), c.docker)
+		return err
+	}
+	if err := c.phase(c.Timeouts.Start, func(ctx context.Context) error {
+		return c.Method.Start(ctx, c.docker)
+	}); err != nil {
+		c.Method.Cleanup(context.Background(), c.docker)
+		return err
+	}
+	c.streams = streams
+	c.copyStreams()
+
+	c.exited = make(chan struct{})
+	c.waitDone = make(chan struct{})
+	c.Process = &Process{
+		ContainerID: c.Method.ContainerID(),
+		method:      c.Method,
+		docker:      c.docker,
+		done:        c.exited,
+	}
+	c.runCtx = c.ctx
+	if c.Timeouts.Run > 0 {
+		c.runCtx, c.cancelRun = context.WithTimeout(c.context(), c.Timeouts.Run)
+	}
+	if c.runCtx != nil {
+		c.ctxErr = make(chan error, 1)
+		go c.watchCtx()
+	}
 	return nil
 }
 
-// Wait waits for the command to exit. It must have been started by Start.
+func (c *Cmd) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// phase runs f with the context of the command, bounded by timeout if it is
+// not zero.
+func (c *Cmd) phase(timeout time.Duration, f func(ctx context.Context) error) error {
+	if timeout <= 0 {
+		return f(c.context())
+	}
+	ctx, cancel := context.WithTimeout(c.context(), timeout)
+	defer cancel()
+	return f(ctx)
+}
+
+func (c *Cmd) stopTimeout() time.Duration {
+	if c.StopTimeout == 0 {
+		return DefaultStopTimeout
+	}
+	return c.StopTimeout
+}
+
+// watchCtx calls Cancel if c.ctx is done or Timeouts.Run elapses before the
+// command exits, kills the command if it does not exit within WaitDelay, and
+// reports the resulting error to Wait.
+func (c *Cmd) watchCtx() {
+	select {
+	case <-c.exited:
+		c.ctxErr <- nil
+		return
+	case <-c.waitDone:
+		c.ctxErr <- nil
+		return
+	case <-c.runCtx.Done():
+	}
+	c.mu.Lock()
+	c.canceledAt = time.Now()
+	c.mu.Unlock()
+
+	// WaitDelay runs from the cancellation, not from the return of Cancel
+	// which may wait for the command to stop
+	var delay <-chan time.Time
+	if c.WaitDelay > 0 {
+		t := time.NewTimer(c.WaitDelay)
+		defer t.Stop()
+		delay = t.C
+	}
+	errc := make(chan error, 1)
+	go func() {
+		var err error
+		if c.Cancel != nil {
+			if cerr := c.Cancel(); cerr == nil {
+				err = c.runCtx.Err()
+			} else if !errors.Is(cerr, os.ErrProcessDone) {
+				err = fmt.Errorf("dexec: canceling Cmd: %w", cerr)
+			}
+		}
+		errc <- err
+	}()
+	if delay != nil {
+		select {
+		case <-c.exited:
+		case <-c.waitDone:
+		case <-delay:
+			// the command ignored the cancellation, if any
+			c.Process.Kill()
+		}
+	}
+	c.ctxErr <- <-errc
+}
+
+// Wait waits for the command to exit. It must have been started by Start,
+// and it returns ErrNotStarted if Start failed.
 //
 // If the container exits with a non-zero exit code, the error is of type
 // *ExitError. Other error types may be returned for I/O problems and such.
@@ -114,19 +369,345 @@ func (c *Cmd) Start() error {
 // associated with Cmd (such as file handles).
 func (c *Cmd) Wait() error {
 	defer closeFds(c.closeAfterWait)
-	if !c.started {
-		return errors.New("dexec: not started")
+	if c.Process == nil {
+		return ErrNotStarted // not started, or Start failed
+	}
+	if c.waited {
+		return ErrAlreadyWaited
+	}
+	c.waited = true
+	status, err := c.wait()
+	close(c.waitDone)
+
+	// a kill by copyStdin must not reach the execution once it is cleaned
+	// up, e.g. a pooled container leased to another command
+	c.mu.Lock()
+	c.exitSeen = true
+	stdinKill := c.stdinKill
+	c.mu.Unlock()
+	if stdinKill != nil {
+		<-stdinKill
+	}
+	if c.cancelRun != nil {
+		defer c.cancelRun()
+	}
+	if err == nil || err == ErrWaitDelay {
+		c.ProcessState = &ProcessState{containerID: c.Process.ContainerID, status: status}
+		if oerr := c.copyOutputs(); oerr != nil {
+			err = oerr
+		} else if oerr := c.reportChanges(); oerr != nil {
+			err = oerr
+		}
+	}
+	var ctxErr error
+	if c.ctxErr != nil {
+		ctxErr = <-c.ctxErr
+	}
+	if cerr := c.Method.Cleanup(context.Background(), c.docker); err == nil && cerr != nil {
+		err = cerr
 	}
-	ec, err := c.Method.wait(c.docker)
 	if err != nil {
 		return err
 	}
-	if ec != 0 {
-		return &ExitError{ExitCode: ec}
+	// the exit status is reported along with the cancellation
+	if ctxErr != nil && status.ExitCode == 0 {
+		return ctxErr
+	}
+	if status.ExitCode != 0 {
+		return &ExitError{
+			ExitCode:    status.ExitCode,
+			ContainerID: c.ProcessState.ContainerID(),
+			Image:       status.Image,
+			OOMKilled:   status.OOMKilled,
+			Signal:      c.ProcessState.Signal(),
+			Duration:    c.ProcessState.Duration(),
+			Stderr:      c.stderrTail.Bytes(),
+			Err:         ctxErr,
+		}
 	}
 	return nil
 }
 
+// Resize resizes the terminal of a command started with a TTY, that is with
+// Config.Tty set for ByCreatingContainer or ExecOption.Tty set for the exec
+// strategies. Callers usually call it with the size of their own terminal as
+// it starts and on every SIGWINCH, after putting the terminal in raw mode.
+func (c *Cmd) Resize(rows, cols uint) error {
+	if c.Process == nil {
+		return ErrNotStarted
+	}
+	r, ok := c.Method.(Resizer)
+	if !ok {
+		return ErrResizeNotSupported
+	}
+	return r.Resize(context.Background(), c.docker, rows, cols)
+}
+
+// copyStreams copies the standard streams of the started command in the
+// background. Once the output is drained, the pipes returned by StdoutPipe and
+// StderrPipe are closed and the result is sent on c.copyDone.
+func (c *Cmd) copyStreams() {
+	s := c.streams
+	c.stdout = &gatedWriter{w: c.Stdout}
+	c.stderr = &gatedWriter{w: io.MultiWriter(c.Stderr, c.stderrTail)}
+	stdout, stderr := c.stdout, c.stderr
+
+	// keep copying stdin to container, closing it signals EOF to the command
+	if s.Stdin != nil {
+		go c.copyStdin(s.Stdin)
+	}
+
+	c.copyDone = make(chan error, 1)
+	go func() {
+		var err error
+		if s.Multiplexed {
+			_, err = stdcopy.StdCopy(stdout, stderr, s.Stdout)
+		} else {
+			errc := make(chan error, 1)
+			go func() {
+				var err error
+				if s.Stderr != nil {
+					_, err = io.Copy(stderr, s.Stderr)
+				}
+				errc <- err
+			}()
+			if s.Stdout != nil {
+				_, err = io.Copy(stdout, s.Stdout)
+			}
+			if err2 := <-errc; err == nil {
+				err = err2
+			}
+		}
+		c.mu.Lock()
+		c.drained = true
+		c.mu.Unlock()
+		closeFds(c.closeAfterWait)
+		c.copyDone <- err
+	}()
+}
+
+// copyStdin copies c.Stdin to the command. If it fails before the output of
+// the command is drained, the command is killed so that it does not go on with
+// a truncated input, and the error is reported by Wait. Later errors are
+// ignored, as the command exited, possibly without reading all of its input,
+// and so are the errors of writing to a closed input.
+func (c *Cmd) copyStdin(stdin io.WriteCloser) {
+	r := &stdinReader{r: c.Stdin}
+	_, err := io.Copy(stdin, r)
+	stdin.Close()
+	if err == nil {
+		return
+	}
+	if r.err != nil {
+		err = r.err // the write error is caused by the failed read, if any
+	} else if stdinClosed(err) {
+		return
+	}
+	c.mu.Lock()
+	if c.drained || c.exitSeen {
+		c.mu.Unlock()
+		return
+	}
+	c.stdinErr = &PhaseError{Phase: PhaseStdin, ContainerID: c.Method.ContainerID(), Err: err}
+	c.stdinKill = make(chan struct{})
+	c.mu.Unlock()
+	c.Method.Kill(context.Background(), c.docker, "SIGKILL")
+	close(c.stdinKill)
+}
+
+// stdinReader records the read error of the standard input, to tell it from
+// the errors writing to the command.
+type stdinReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *stdinReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// stdinClosed reports whether err is the error of writing to the standard
+// input of a command that exited or closed it. Like os/exec, such errors are
+// not reported: the command need not read all of its input.
+func stdinClosed(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, net.ErrClosed)
+}
+
+// gatedWriter writes to w until it is closed, so that an output copy
+// abandoned after WaitDelay does not write to Stdout or Stderr once Wait
+// returns.
+type gatedWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closed bool
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, ErrWaitDelay
+	}
+	return w.w.Write(p)
+}
+
+func (w *gatedWriter) Close() error {
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+	return nil
+}
+
+// wait waits for the command to exit and for its output to be drained.
+func (c *Cmd) wait() (ExitStatus, error) {
+	type result struct {
+		status ExitStatus
+		err    error
+	}
+	exited := make(chan result, 1)
+	go func() {
+		status, err := c.Method.Wait(context.Background(), c.docker)
+		close(c.exited)
+		exited <- result{status, err}
+	}()
+
+	var res result
+	var copyErr error
+	select {
+	case copyErr = <-c.copyDone:
+		if copyErr != nil {
+			return ExitStatus{ExitCode: -1}, &PhaseError{Phase: PhaseAttach, ContainerID: c.Process.ContainerID, Err: copyErr}
+		}
+		res = <-exited
+	case res = <-exited:
+		copyErr = c.drain()
+	}
+	if res.err != nil {
+		return res.status, res.err
+	}
+
+	c.mu.Lock()
+	stdinErr := c.stdinErr
+	c.mu.Unlock()
+	switch {
+	case stdinErr != nil:
+		return res.status, stdinErr
+	case copyErr == ErrWaitDelay:
+		if res.status.ExitCode != 0 || c.canceled() {
+			return res.status, nil // the exit status or the cancellation prevails
+		}
+		return res.status, ErrWaitDelay
+	case copyErr != nil:
+		return res.status, &PhaseError{Phase: PhaseAttach, ContainerID: c.Process.ContainerID, Err: copyErr}
+	}
+	return res.status, nil
+}
+
+func (c *Cmd) canceled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.canceledAt.IsZero()
+}
+
+// drain waits for the output of the exited command to be drained, for at most
+// WaitDelay since the command exited or Cancel was called if it is set.
+func (c *Cmd) drain() error {
+	if c.WaitDelay <= 0 {
+		return <-c.copyDone
+	}
+	delay := c.WaitDelay
+	c.mu.Lock()
+	if !c.canceledAt.IsZero() {
+		delay -= time.Since(c.canceledAt)
+	}
+	c.mu.Unlock()
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case err := <-c.copyDone:
+		return err
+	case <-t.C:
+		c.stdout.Close()
+		c.stderr.Close()
+		closeFds(c.closeAfterWait)
+		return ErrWaitDelay
+	}
+}
+
+func (c *Cmd) fileCopier() (FileCopier, error) {
+	fc, ok := c.Method.(FileCopier)
+	if !ok {
+		return nil, ErrCopyNotSupported
+	}
+	return fc, nil
+}
+
+func (c *Cmd) copyInputs() error {
+	if len(c.Inputs) == 0 {
+		return nil
+	}
+	fc, err := c.fileCopier()
+	if err != nil {
+		return err
+	}
+	for _, in := range c.Inputs {
+		r, err := in.archive()
+		if err != nil {
+			return err
+		}
+		err = fc.CopyTo(c.context(), c.docker, "/", r)
+		r.CloseWithError(err) // stops writing the archive if it was not read
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cmd) copyOutputs() error {
+	if len(c.Outputs) == 0 {
+		return nil
+	}
+	fc, err := c.fileCopier()
+	if err != nil {
+		return err
+	}
+	for _, out := range c.Outputs {
+		if err := out.collect(context.Background(), c.docker, fc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cmd) reportChanges() error {
+	if !c.ReportChanges {
+		return nil
+	}
+	differ, ok := c.Method.(Differ)
+	if !ok {
+		return ErrDiffNotSupported
+	}
+	changes, err := differ.Diff(context.Background(), c.docker)
+	if err != nil {
+		return err
+	}
+	c.ProcessState.changes = changes
+	if c.ChangesArchive == nil {
+		return nil
+	}
+	fc, err := c.fileCopier()
+	if err != nil {
+		return err
+	}
+	return exportChanges(context.Background(), c.docker, fc, changes, c.ChangesArchive)
+}
+
 // Run starts the specified command and waits for it to complete.
 //
 // If the command runs successfully and copying streams are done as expected,
@@ -145,14 +726,16 @@ func (c *Cmd) Run() error {
 // standard error.
 //
 // Docker API does not have strong guarantees over ordering of messages. For instance:
-//     >&1 echo out; >&2 echo err
+//
+//	>&1 echo out; >&2 echo err
+//
 // may result in "out\nerr\n" as well as "err\nout\n" from this method.
 func (c *Cmd) CombinedOutput() ([]byte, error) {
 	if c.Stdout != nil {
-		return nil, errors.New("dexec: Stdout already set")
+		return nil, ErrStdoutAlreadySet
 	}
 	if c.Stderr != nil {
-		return nil, errors.New("dexec: Stderr already set")
+		return nil, ErrStderrAlreadySet
 	}
 	var b bytes.Buffer
 	c.Stdout, c.Stderr = &b, &b
@@ -164,25 +747,13 @@ func (c *Cmd) CombinedOutput() ([]byte, error) {
 //
 // If the container exits with a non-zero exit code, the error is of type
 // *ExitError. Other error types may be returned for I/O problems and such.
-//
-// If c.Stderr was nil, Output populates ExitError.Stderr.
 func (c *Cmd) Output() ([]byte, error) {
 	if c.Stdout != nil {
-		return nil, errors.New("dexec: Stdout already set")
+		return nil, ErrStdoutAlreadySet
 	}
-	var stdout, stderr bytes.Buffer
+	var stdout bytes.Buffer
 	c.Stdout = &stdout
-
-	captureErr := c.Stderr == nil
-	if captureErr {
-		c.Stderr = &stderr
-	}
 	err := c.Run()
-	if err != nil && captureErr {
-		if ee, ok := err.(*ExitError); ok {
-			ee.Stderr = stderr.Bytes()
-		}
-	}
 	return stdout.Bytes(), err
 }
 
@@ -192,7 +763,7 @@ func (c *Cmd) Output() ([]byte, error) {
 // Different than os/exec.StdinPipe, returned io.WriteCloser should be closed by user.
 func (c *Cmd) StdinPipe() (io.WriteCloser, error) {
 	if c.Stdin != nil {
-		return nil, errors.New("dexec: Stdin already set")
+		return nil, ErrStdinAlreadySet
 	}
 	pr, pw := io.Pipe()
 	c.Stdin = pr
@@ -202,10 +773,11 @@ func (c *Cmd) StdinPipe() (io.WriteCloser, error) {
 // StdoutPipe returns a pipe that will be connected to the command's standard output when
 // the command starts.
 //
-// Wait will close the pipe after seeing the command exit or in error conditions.
+// The pipe is closed once the output of the command is drained, so it is
+// incorrect to call Wait before all reads from the pipe have completed.
 func (c *Cmd) StdoutPipe() (io.ReadCloser, error) {
 	if c.Stdout != nil {
-		return nil, errors.New("dexec: Stdout already set")
+		return nil, ErrStdoutAlreadySet
 	}
 	pr, pw := io.Pipe()
 	c.Stdout = pw
@@ -216,10 +788,11 @@ func (c *Cmd) StdoutPipe() (io.ReadCloser, error) {
 // StderrPipe returns a pipe that will be connected to the command's standard error when
 // the command starts.
 //
-// Wait will close the pipe after seeing the command exit or in error conditions.
+// The pipe is closed once the output of the command is drained, so it is
+// incorrect to call Wait before all reads from the pipe have completed.
 func (c *Cmd) StderrPipe() (io.ReadCloser, error) {
 	if c.Stderr != nil {
-		return nil, errors.New("dexec: Stderr already set")
+		return nil, ErrStderrAlreadySet
 	}
 	pr, pw := io.Pipe()
 	c.Stderr = pw
@@ -0,0 +1,76 @@
+// Command dexec-reap removes the containers left behind by dexec, such as the
+// ones of a process that crashed while running commands.
+//
+// Usage:
+//
+//	dexec-reap [-orphans] [-max-age duration] [-job id] [-label key=value]... [-sweep]
+//
+// The Docker engine is configured from the environment, like the Docker CLI.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	docker "github.com/docker/docker/client"
+	dexec "github.com/silentred/go-dexec"
+)
+
+type labelsFlag map[string]string
+
+func (l labelsFlag) String() string { return fmt.Sprint(map[string]string(l)) }
+
+func (l labelsFlag) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("label %q is not key=value", s)
+	}
+	l[k] = v
+	return nil
+}
+
+func main() {
+	var filter dexec.ReapFilter
+	labels := labelsFlag{}
+	flag.BoolVar(&filter.Orphans, "orphans", false, "remove the containers whose owner process on this host is gone")
+	flag.DurationVar(&filter.MaxAge, "max-age", 0, "remove the containers created longer ago")
+	flag.StringVar(&filter.JobID, "job", "", "only consider the containers of the job")
+	flag.Var(labels, "label", "only consider the containers with the `key=value` label (repeatable)")
+	sweep := flag.Bool("sweep", false, "also remove the retained containers whose retention expired")
+	flag.Parse()
+	filter.Labels = labels
+
+	if !filter.Orphans && filter.MaxAge == 0 && !*sweep {
+		fmt.Fprintln(os.Stderr, "dexec-reap: one of -orphans, -max-age or -sweep is required")
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cl, err := docker.NewEnvClient()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dexec-reap:", err)
+		os.Exit(1)
+	}
+	d := dexec.Docker{Client: cl}
+	ctx := context.Background()
+
+	var removed []string
+	if filter.Orphans || filter.MaxAge > 0 {
+		removed, err = d.Reap(ctx, filter)
+	}
+	if err == nil && *sweep {
+		var swept []string
+		swept, err = d.SweepRetained(ctx)
+		removed = append(removed, swept...)
+	}
+	for _, id := range removed {
+		fmt.Println(id)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "dexec-reap:", err)
+		os.Exit(1)
+	}
+}
@@ -1,17 +1,29 @@
 package dexec_test
 
 import (
+	"archive/tar"
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"testing"
+	"testing/fstest"
+	"testing/iotest"
+	"time"
 
+	types "github.com/docker/docker/api/types"
+	containertypes "github.com/docker/docker/api/types/container"
 	docker "github.com/docker/docker/client"
 	dexec "github.com/silentred/go-dexec"
 	. "gopkg.in/check.v1"
@@ -28,7 +40,7 @@ const testPrefix = "dexec_test_"
 func testContainer() string { return fmt.Sprintf("%s%d", testPrefix, rand.Int63()) }
 
 func testDocker(c *C) *docker.Client {
-	cl, err := docker.NewClient("unix:///var/run/docker.sock")
+	cl, err := docker.NewEnvClient()
 	c.Assert(err, IsNil)
 	return cl
 }
@@ -38,8 +50,12 @@ type CmdTestSuite struct {
 }
 
 func (s *CmdTestSuite) SetUpSuite(c *C) {
-	s.d = dexec.Docker{testDocker(c)}
-	err := s.d.PullImage(docker.PullImageOptions{Repository: "busybox", Tag: "latest"}, docker.AuthConfiguration{})
+	cl := testDocker(c)
+	if _, err := cl.Ping(context.Background()); err != nil {
+		c.Skip(fmt.Sprintf("no Docker engine: %v", err))
+	}
+	s.d = dexec.Docker{cl}
+	err := s.d.PullImage(context.Background(), "busybox:latest", nil, nil)
 	c.Assert(err, IsNil)
 	cleanupContainers(c, s.d)
 }
@@ -49,14 +65,13 @@ func (s *CmdTestSuite) SetUpTest(c *C) {
 }
 
 func cleanupContainers(c *C, cl dexec.Docker) {
-	l, err := cl.ListContainers(docker.ListContainersOptions{All: true})
+	ctx := context.Background()
+	l, err := cl.ContainerList(ctx, types.ContainerListOptions{All: true})
 	c.Assert(err, IsNil)
 	for _, v := range l {
 		for _, n := range v.Names {
 			if strings.HasPrefix(strings.TrimPrefix(n, "/"), testPrefix) {
-				err = cl.RemoveContainer(docker.RemoveContainerOptions{
-					ID:    v.ID,
-					Force: true})
+				err = cl.ContainerRemove(ctx, v.ID, types.ContainerRemoveOptions{Force: true})
 				c.Assert(err, IsNil)
 				c.Logf("removed container %s", n)
 			}
@@ -64,10 +79,10 @@ func cleanupContainers(c *C, cl dexec.Docker) {
 	}
 }
 
-func baseOpts() docker.CreateContainerOptions {
-	return docker.CreateContainerOptions{
-		Name: testContainer(),
-		Config: &docker.Config{
+func baseOpts() dexec.CreateContainerOption {
+	return dexec.CreateContainerOption{
+		ContainerName: testContainer(),
+		Config: &containertypes.Config{
 			Image: "busybox",
 		}}
 }
@@ -109,6 +124,7 @@ func (s *CmdTestSuite) TestDoubleStart(c *C) {
 	err := cmd.Start()
 	c.Assert(err, NotNil)
 	c.Assert(err, ErrorMatches, "dexec: already started")
+	c.Assert(err, Equals, dexec.ErrAlreadyStarted)
 }
 
 func (s *CmdTestSuite) TestWaitBeforestart(c *C) {
@@ -195,6 +211,38 @@ func (s *CmdTestSuite) TestNonExisitingCommand(c *C) {
 	err := cmd.Run()
 	c.Assert(err, NotNil)
 	c.Assert(strings.HasPrefix(err.Error(), `dexec: failed to start container:`), Equals, true)
+
+	var pe *dexec.PhaseError
+	c.Assert(errors.As(err, &pe), Equals, true)
+	c.Assert(pe.Phase, Equals, dexec.PhaseStart)
+	c.Assert(pe.ContainerID, Not(Equals), "")
+	c.Assert(pe.Err, NotNil)
+}
+
+func (s *CmdTestSuite) TestImageNotFound(c *C) {
+	opts := baseOpts()
+	opts.Config.Image = "dexec-test-no-such-image"
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+	err = s.d.Command(e, "true").Run()
+	c.Assert(errors.Is(err, dexec.ErrImageNotFound), Equals, true)
+
+	var pe *dexec.PhaseError
+	c.Assert(errors.As(err, &pe), Equals, true)
+	c.Assert(pe.Phase, Equals, dexec.PhaseCreate)
+}
+
+func (s *CmdTestSuite) TestNetworkNotFound(c *C) {
+	opts := baseOpts()
+	opts.HostConfig = &containertypes.HostConfig{NetworkMode: "dexec-test-no-such-network"}
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+	err = s.d.Command(e, "true").Run()
+	c.Assert(errors.Is(err, dexec.ErrImageNotFound), Equals, false)
+
+	var pe *dexec.PhaseError
+	c.Assert(errors.As(err, &pe), Equals, true)
+	c.Assert(pe.Phase, Equals, dexec.PhaseCreate)
 }
 
 func (s *CmdTestSuite) TestFailedCommandReturnsExitError(c *C) {
@@ -209,11 +257,14 @@ func (s *CmdTestSuite) TestNonZeroExitCodeReturnedInError(c *C) {
 	err := cmd.Run()
 	c.Assert(err, NotNil)
 	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
-	c.Assert(err, ErrorMatches, "dexec: exit status: 3")
+	c.Assert(err, ErrorMatches, `dexec: exit status: 3 \(container: \w+, image: busybox\)`)
 
 	ecErr := err.(*dexec.ExitError)
 	c.Assert(ecErr.ExitCode, Equals, 3)
-	c.Assert(ecErr.Stderr, IsNil) // Run() shouldn't set ExitError.Stderr
+	c.Assert(ecErr.Image, Equals, "busybox")
+	c.Assert(ecErr.ContainerID, Equals, cmd.ProcessState.ContainerID())
+	c.Assert(ecErr.Signal, IsNil)
+	c.Assert(string(ecErr.Stderr), Equals, "error\n") // collected by Run() as well
 }
 
 func (s *CmdTestSuite) TestRunBasicCommandReadStdout(c *C) {
@@ -283,7 +334,7 @@ func (s *CmdTestSuite) TestCombinedOutputStdoutAlreadySet(c *C) {
 	cmd := s.d.Command(baseContainer(c), "env")
 	cmd.Stdout = &b
 	_, err := cmd.CombinedOutput()
-	c.Assert(err, ErrorMatches, "dexec: Stdout already set")
+	c.Assert(err, Equals, dexec.ErrStdoutAlreadySet)
 }
 
 func (s *CmdTestSuite) TestCombinedOutputStderrAlreadySet(c *C) {
@@ -317,14 +368,26 @@ func (s *CmdTestSuite) TestOutputSuccessfulCommand(c *C) {
 	c.Assert(string(b), Equals, "out\n")
 }
 
-func (s *CmdTestSuite) TestOutputExitErrorStderrNotCollected(c *C) {
+func (s *CmdTestSuite) TestOutputExitErrorStderrCollectedWithStderrSet(c *C) {
 	var b bytes.Buffer
 	cmd := s.d.Command(baseContainer(c), "sh", "-c", "echo out; >&2 echo err; exit 1")
-	cmd.Stderr = &b // set Stderr so that ExitError doesn't collect
+	cmd.Stderr = &b
 	_, err := cmd.Output()
 	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
 	ee := err.(*dexec.ExitError)
-	c.Assert(ee.Stderr, IsNil)
+	c.Assert(string(ee.Stderr), Equals, "err\n")
+	c.Assert(b.String(), Equals, "err\n")
+}
+
+func (s *CmdTestSuite) TestExitErrorStderrIsBounded(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "echo begin >&2; head -c 100000 /dev/zero | tr '\\0' x >&2; echo end >&2; exit 1")
+	err := cmd.Run()
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+	stderr := string(err.(*dexec.ExitError).Stderr)
+	c.Assert(len(stderr) < 100000, Equals, true)
+	c.Assert(strings.HasPrefix(stderr, "begin\n"), Equals, true)
+	c.Assert(strings.HasSuffix(stderr, "xend\n"), Equals, true)
+	c.Assert(strings.Contains(stderr, "\n... omitting "), Equals, true)
 }
 
 func (s *CmdTestSuite) TestOutputExitErrorStderrCollected(c *C) {
@@ -422,10 +485,6 @@ func (s *CmdTestSuite) TestStdoutPipe(c *C) {
 }
 
 func (s *CmdTestSuite) TestStdoutPipeJSONDecoding(c *C) {
-	// TODO this test does not use goroutines and follows os/exec pattern
-	// however 10% of the time it hangs. there's some timing issue somewhere.
-	c.Skip("not using goroutines here sometimes hangs forever")
-
 	cmd := s.d.Command(baseContainer(c), "echo", `{"Name":"Bob", "Age": 32}`)
 	r, err := cmd.StdoutPipe()
 	c.Assert(err, IsNil)
@@ -481,17 +540,17 @@ func (s *CmdTestSuite) TestWaitDeletesContainer(c *C) {
 	opts := baseOpts()
 	e, err := dexec.ByCreatingContainer(opts)
 	c.Assert(err, IsNil)
-	name := opts.Name
+	name := opts.ContainerName
 	c.Logf("container=%q", name)
 	cmd := s.d.Command(e, "date")
 	c.Assert(cmd.Start(), IsNil)
 
 	d := testDocker(c)
-	_, err = d.InspectContainer(name)
+	_, err = d.ContainerInspect(context.Background(), name)
 	c.Assert(err, IsNil)
 
 	c.Assert(cmd.Wait(), IsNil)
-	_, err = d.InspectContainer(name)
+	_, err = d.ContainerInspect(context.Background(), name)
 	c.Assert(err, NotNil)
 }
 
@@ -499,16 +558,665 @@ func (s *CmdTestSuite) TestWaitDeletesContainerOnExitError(c *C) {
 	opts := baseOpts()
 	e, err := dexec.ByCreatingContainer(opts)
 	c.Assert(err, IsNil)
-	name := opts.Name
+	name := opts.ContainerName
 	c.Logf("container=%q", name)
 	cmd := s.d.Command(e, "false")
 	c.Assert(cmd.Start(), IsNil)
 
 	d := testDocker(c)
-	_, err = d.InspectContainer(name)
+	_, err = d.ContainerInspect(context.Background(), name)
 	c.Assert(err, IsNil)
 
 	c.Assert(cmd.Wait(), FitsTypeOf, &dexec.ExitError{})
-	_, err = d.InspectContainer(name)
+	_, err = d.ContainerInspect(context.Background(), name)
 	c.Assert(err, NotNil)
 }
+
+func (s *CmdTestSuite) TestCommandContextAlreadyDone(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cmd := s.d.CommandContext(ctx, baseContainer(c), "echo")
+	c.Assert(cmd.Start(), Equals, context.Canceled)
+}
+
+func (s *CmdTestSuite) TestCommandContextTimeoutRemovesContainer(c *C) {
+	opts := baseOpts()
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+	name := opts.ContainerName
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	cmd := s.d.CommandContext(ctx, e, "sleep", "60")
+	cmd.StopTimeout = time.Second
+
+	start := time.Now()
+	err = cmd.Run()
+	c.Assert(time.Since(start) < 30*time.Second, Equals, true)
+	c.Assert(errors.Is(err, context.DeadlineExceeded), Equals, true)
+	// the killed command also reports its exit status
+	var ee *dexec.ExitError
+	c.Assert(errors.As(err, &ee), Equals, true)
+
+	d := testDocker(c)
+	_, err = d.ContainerInspect(context.Background(), name)
+	c.Assert(err, NotNil)
+}
+
+// runningContainer starts a container that stays idle until it is removed.
+func (s *CmdTestSuite) runningContainer(c *C) string {
+	ctx := context.Background()
+	resp, err := s.d.ContainerCreate(ctx, &containertypes.Config{
+		Image:      "busybox",
+		Entrypoint: []string{"tail", "-f", "/dev/null"},
+	}, nil, nil, testContainer())
+	c.Assert(err, IsNil)
+	c.Assert(s.d.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}), IsNil)
+	return resp.ID
+}
+
+func (s *CmdTestSuite) TestExecInContainer(c *C) {
+	id := s.runningContainer(c)
+	e, err := dexec.ByExecInContainer(id, dexec.ExecOption{Env: []string{"A=B"}})
+	c.Assert(err, IsNil)
+
+	cmd := s.d.Command(e, "sh", "-c", "echo $A; >&2 echo err; cat")
+	cmd.Stdin = strings.NewReader("in\n")
+	var outS, errS bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &outS, &errS
+	c.Assert(cmd.Run(), IsNil)
+	c.Assert(outS.String(), Equals, "B\nin\n")
+	c.Assert(errS.String(), Equals, "err\n")
+
+	// the container is reusable
+	e, err = dexec.ByExecInContainer(id, dexec.ExecOption{})
+	c.Assert(err, IsNil)
+	b, err := s.d.Command(e, "echo", "again").Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "again\n")
+}
+
+func (s *CmdTestSuite) TestExecInContainerExitError(c *C) {
+	e, err := dexec.ByExecInContainer(s.runningContainer(c), dexec.ExecOption{User: "nobody"})
+	c.Assert(err, IsNil)
+	err = s.d.Command(e, "sh", "-c", "[ $(id -u) = 65534 ] && exit 7").Run()
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+	c.Assert(err.(*dexec.ExitError).ExitCode, Equals, 7)
+}
+
+func (s *CmdTestSuite) TestExecSignal(c *C) {
+	e, err := dexec.ByExecInContainer(s.runningContainer(c), dexec.ExecOption{})
+	c.Assert(err, IsNil)
+	cmd := s.d.Command(e, "sh", "-c", "trap 'echo hup; exit 3' HUP; echo ready; while :; do sleep 1; done")
+	out, err := cmd.StdoutPipe()
+	c.Assert(err, IsNil)
+	c.Assert(cmd.Start(), IsNil)
+
+	errc := make(chan error, 1)
+	go func() { errc <- cmd.Wait() }()
+	b := make([]byte, len("ready\n"))
+	_, err = io.ReadFull(out, b)
+	c.Assert(err, IsNil)
+	c.Assert(cmd.Process.Signal(syscall.SIGHUP), IsNil)
+	rest, err := ioutil.ReadAll(out)
+	c.Assert(err, IsNil)
+	c.Assert(string(rest), Equals, "hup\n")
+
+	err = <-errc
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+	c.Assert(err.(*dexec.ExitError).ExitCode, Equals, 3)
+}
+
+func (s *CmdTestSuite) TestExecContextTimeout(c *C) {
+	e, err := dexec.ByExecInContainer(s.runningContainer(c), dexec.ExecOption{})
+	c.Assert(err, IsNil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	start := time.Now()
+	err = s.d.CommandContext(ctx, e, "sleep", "60").Run()
+	c.Assert(time.Since(start) < 30*time.Second, Equals, true)
+	c.Assert(errors.Is(err, context.DeadlineExceeded), Equals, true)
+	c.Assert(err.(*dexec.ExitError).ExitCode, Equals, 143)
+}
+
+func (s *CmdTestSuite) TestPoolReuseWithCleanDir(c *C) {
+	p, err := dexec.NewPool(s.d, dexec.PoolOption{
+		Container: dexec.CreateContainerOption{
+			Config: &containertypes.Config{Image: "busybox", WorkingDir: "/work"}},
+		Min:   1,
+		Max:   1,
+		Reset: dexec.ReuseWithCleanDir,
+	})
+	c.Assert(err, IsNil)
+	defer p.Close(context.Background())
+
+	b, err := s.d.Command(p.Execution(dexec.ExecOption{}), "sh", "-c", "touch f .hidden; hostname").Output()
+	c.Assert(err, IsNil)
+	host := string(b)
+
+	b, err = s.d.Command(p.Execution(dexec.ExecOption{}), "sh", "-c", "ls -A; hostname").Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, host) // same container, empty dir
+}
+
+func (s *CmdTestSuite) TestPoolDiscardAfterUse(c *C) {
+	p, err := dexec.NewPool(s.d, dexec.PoolOption{
+		Container: dexec.CreateContainerOption{
+			Config: &containertypes.Config{Image: "busybox"}},
+		Max: 2,
+	})
+	c.Assert(err, IsNil)
+
+	hosts := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		b, err := s.d.Command(p.Execution(dexec.ExecOption{}), "hostname").Output()
+		c.Assert(err, IsNil)
+		hosts[string(b)] = true
+	}
+	c.Assert(hosts, HasLen, 3)
+	c.Assert(p.Close(context.Background()), IsNil)
+
+	_, err = s.d.Command(p.Execution(dexec.ExecOption{}), "true").Output()
+	c.Assert(err, Equals, dexec.ErrPoolClosed)
+}
+
+func (s *CmdTestSuite) TestProcessSignal(c *C) {
+	opts := baseOpts()
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+	cmd := s.d.Command(e, "sh", "-c", "trap 'echo hup; exit 3' HUP; echo ready; while :; do sleep 1; done")
+	out, err := cmd.StdoutPipe()
+	c.Assert(err, IsNil)
+	c.Assert(cmd.Start(), IsNil)
+	c.Assert(cmd.Process, NotNil)
+	c.Assert(cmd.Process.ContainerID, Not(Equals), "")
+
+	errc := make(chan error, 1)
+	go func() { errc <- cmd.Wait() }()
+
+	b := make([]byte, len("ready\n"))
+	_, err = io.ReadFull(out, b)
+	c.Assert(err, IsNil)
+	c.Assert(cmd.Process.Signal(syscall.SIGHUP), IsNil)
+	rest, err := ioutil.ReadAll(out)
+	c.Assert(err, IsNil)
+	c.Assert(string(rest), Equals, "hup\n")
+
+	err = <-errc
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+	c.Assert(err.(*dexec.ExitError).ExitCode, Equals, 3)
+}
+
+func (s *CmdTestSuite) TestProcessStop(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "trap '' TERM; while :; do sleep 1; done")
+	c.Assert(cmd.Start(), IsNil)
+
+	errc := make(chan error, 1)
+	go func() { errc <- cmd.Wait() }()
+	c.Assert(cmd.Process.Stop(time.Second), IsNil)
+
+	err := <-errc
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+	c.Assert(err.(*dexec.ExitError).ExitCode, Equals, 137)
+}
+
+func (s *CmdTestSuite) TestProcessState(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "sleep .2; exit 2")
+	c.Assert(cmd.ProcessState, IsNil)
+	c.Assert(cmd.Run(), FitsTypeOf, &dexec.ExitError{})
+
+	ps := cmd.ProcessState
+	c.Assert(ps, NotNil)
+	c.Assert(ps.ContainerID(), Equals, cmd.Process.ContainerID)
+	c.Assert(ps.ExitCode(), Equals, 2)
+	c.Assert(ps.Success(), Equals, false)
+	c.Assert(ps.OOMKilled(), Equals, false)
+	c.Assert(ps.Signal(), IsNil)
+	c.Assert(ps.Duration() >= 200*time.Millisecond, Equals, true)
+	c.Assert(ps.String(), Equals, "exit status 2")
+}
+
+func (s *CmdTestSuite) TestProcessStateOOMKilled(c *C) {
+	opts := baseOpts()
+	opts.HostConfig = &containertypes.HostConfig{
+		Resources: containertypes.Resources{Memory: 8 * 1024 * 1024}}
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+
+	cmd := s.d.Command(e, "sh", "-c", "x=x; while :; do x=$x$x; done")
+	c.Assert(cmd.Run(), FitsTypeOf, &dexec.ExitError{})
+	c.Assert(cmd.ProcessState.OOMKilled(), Equals, true)
+	c.Assert(cmd.ProcessState.Signal(), Equals, syscall.SIGKILL)
+}
+
+func (s *CmdTestSuite) TestPullAlwaysReportsProgress(c *C) {
+	var reports []dexec.PullProgress
+	opts := baseOpts()
+	opts.PullPolicy = dexec.PullAlways
+	opts.PullProgress = func(p dexec.PullProgress) { reports = append(reports, p) }
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+
+	b, err := s.d.Command(e, "echo", "pulled").Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "pulled\n")
+	c.Assert(len(reports) > 0, Equals, true)
+	c.Assert(strings.HasPrefix(reports[len(reports)-1].Status, "Status:"), Equals, true)
+}
+
+func (s *CmdTestSuite) TestPullIfNotPresentMissingImage(c *C) {
+	opts := baseOpts()
+	opts.Config.Image = "dexec-test-no-such-image"
+	opts.PullPolicy = dexec.PullIfNotPresent
+	e, err := dexec.ByCreatingContainer(opts)
+	c.Assert(err, IsNil)
+
+	err = s.d.Command(e, "true").Run()
+	var pe *dexec.PhaseError
+	c.Assert(errors.As(err, &pe), Equals, true)
+	c.Assert(pe.Phase, Equals, dexec.PhasePull)
+}
+
+func (s *CmdTestSuite) TestInputs(c *C) {
+	dir := c.MkDir()
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "host.txt"), []byte("from host"), 0644), IsNil)
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "sub/tar.txt", Mode: 0644, Size: 8}), IsNil)
+	_, err := tw.Write([]byte("from tar"))
+	c.Assert(err, IsNil)
+	c.Assert(tw.Close(), IsNil)
+
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "cat /in/a/b.txt /in/host.txt /in/sub/tar.txt")
+	cmd.Inputs = []dexec.Input{
+		{Dest: "/in", Files: map[string][]byte{"a/b.txt": []byte("in memory,")}},
+		{Dest: "/in", HostPath: filepath.Join(dir, "host.txt")},
+		{Dest: "/in", Archive: &archive},
+	}
+	b, err := cmd.CombinedOutput()
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "in memory,from hostfrom tar")
+}
+
+func (s *CmdTestSuite) TestOutputs(c *C) {
+	dir := c.MkDir()
+	var archive bytes.Buffer
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "mkdir -p /out/d; echo a > /out/a.pdf; echo b > /out/b.txt; echo c > /out/d/c.pdf; exit 1")
+	cmd.Outputs = []dexec.Output{
+		{Pattern: "/out/*.pdf", HostDir: dir},
+		{Pattern: "/out/d", Archive: &archive},
+	}
+	c.Assert(cmd.Run(), FitsTypeOf, &dexec.ExitError{}) // collected regardless
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "a.pdf"))
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "a\n")
+	_, err = os.Stat(filepath.Join(dir, "b.txt"))
+	c.Assert(os.IsNotExist(err), Equals, true)
+
+	var names []string
+	tr := tar.NewReader(&archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		names = append(names, hdr.Name)
+	}
+	c.Assert(names, DeepEquals, []string{"d", "d/c.pdf"})
+}
+
+func (s *CmdTestSuite) TestReportChanges(c *C) {
+	var archive bytes.Buffer
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "mkdir /out; echo a > /out/a")
+	cmd.ReportChanges = true
+	cmd.ChangesArchive = &archive
+	c.Assert(cmd.Run(), IsNil)
+
+	changes := map[string]dexec.ChangeKind{}
+	for _, ch := range cmd.ProcessState.Changes() {
+		changes[ch.Path] = ch.Kind
+	}
+	c.Assert(changes["/out"], Equals, dexec.ChangeAdd)
+	c.Assert(changes["/out/a"], Equals, dexec.ChangeAdd)
+
+	files := map[string]string{}
+	tr := tar.NewReader(&archive)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		b, err := ioutil.ReadAll(tr)
+		c.Assert(err, IsNil)
+		files[hdr.Name] = string(b)
+	}
+	c.Assert(files["out/a"], Equals, "a\n")
+}
+
+func (s *CmdTestSuite) TestReportChangesNotSupported(c *C) {
+	id := s.runningContainer(c)
+	e, err := dexec.ByExecInContainer(id, dexec.ExecOption{})
+	c.Assert(err, IsNil)
+	cmd := s.d.Command(e, "true")
+	cmd.ReportChanges = true
+	c.Assert(errors.Is(cmd.Run(), dexec.ErrDiffNotSupported), Equals, true)
+}
+
+func (s *CmdTestSuite) TestCommit(c *C) {
+	e, err := dexec.ByCreatingContainer(dexec.CreateContainerOption{
+		Config: &containertypes.Config{Image: "busybox"},
+		Commit: &dexec.CommitOption{
+			Repo:   "dexec-test-commit",
+			Labels: map[string]string{"dexec.test": "commit"},
+		},
+	})
+	c.Assert(err, IsNil)
+	cmd := s.d.Command(e, "sh", "-c", "echo layer > /layer")
+	c.Assert(cmd.Run(), IsNil)
+	image := cmd.ProcessState.CommittedImage()
+	c.Assert(image, Not(Equals), "")
+	defer s.d.Client.(*docker.Client).ImageRemove(context.Background(), image, types.ImageRemoveOptions{Force: true})
+
+	info, _, err := s.d.ImageInspectWithRaw(context.Background(), "dexec-test-commit:latest")
+	c.Assert(err, IsNil)
+	c.Assert(info.ID, Equals, image)
+	c.Assert(info.Config.Labels["dexec.test"], Equals, "commit")
+	c.Assert(info.Config.Labels[dexec.LabelManaged], Equals, "") // not reapable
+
+	e, err = dexec.ByCreatingContainer(dexec.CreateContainerOption{
+		Config: &containertypes.Config{Image: image},
+	})
+	c.Assert(err, IsNil)
+	out, err := s.d.Command(e, "cat", "/layer").Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(out), Equals, "layer\n")
+}
+
+func (s *CmdTestSuite) TestCommitSkippedOnFailure(c *C) {
+	e, err := dexec.ByCreatingContainer(dexec.CreateContainerOption{
+		Config: &containertypes.Config{Image: "busybox"},
+		Commit: &dexec.CommitOption{},
+	})
+	c.Assert(err, IsNil)
+	cmd := s.d.Command(e, "false")
+	c.Assert(cmd.Run(), FitsTypeOf, &dexec.ExitError{})
+	c.Assert(cmd.ProcessState.CommittedImage(), Equals, "")
+}
+
+func (s *CmdTestSuite) TestBuildImage(c *C) {
+	opt := dexec.BuildOption{
+		Dockerfile: "FROM busybox\nCOPY greet.sh /greet.sh\nCOPY name /name\n",
+		FS:         fstest.MapFS{"greet.sh": {Data: []byte("#!/bin/sh\necho hello $(cat /name)\n"), Mode: 0755}},
+		Files:      map[string][]byte{"name": []byte(testContainer())},
+	}
+	var out bytes.Buffer
+	opt.Output = &out
+	ref, err := s.d.BuildImage(context.Background(), opt)
+	c.Assert(err, IsNil)
+	defer s.d.Client.(*docker.Client).ImageRemove(context.Background(), ref, types.ImageRemoveOptions{Force: true})
+	c.Assert(strings.HasPrefix(ref, dexec.DefaultBuildRepo+":"), Equals, true)
+	c.Assert(out.Len(), Not(Equals), 0)
+
+	// same content, no build
+	out.Reset()
+	cached, err := s.d.BuildImage(context.Background(), opt)
+	c.Assert(err, IsNil)
+	c.Assert(cached, Equals, ref)
+	c.Assert(out.Len(), Equals, 0)
+
+	e, err := dexec.ByCreatingContainer(dexec.CreateContainerOption{
+		Config: &containertypes.Config{Image: ref},
+	})
+	c.Assert(err, IsNil)
+	b, err := s.d.Command(e, "/greet.sh").Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "hello "+string(opt.Files["name"])+"\n")
+}
+
+func (s *CmdTestSuite) TestBuildImageError(c *C) {
+	_, err := s.d.BuildImage(context.Background(), dexec.BuildOption{
+		Dockerfile: "FROM busybox\nRUN exit 3\n",
+	})
+	var pe *dexec.PhaseError
+	c.Assert(errors.As(err, &pe), Equals, true)
+	c.Assert(pe.Phase, Equals, dexec.PhaseBuild)
+}
+
+func (s *CmdTestSuite) TestTty(c *C) {
+	e, err := dexec.ByCreatingContainer(dexec.CreateContainerOption{
+		Config: &containertypes.Config{Image: "busybox", Tty: true},
+	})
+	c.Assert(err, IsNil)
+	var out bytes.Buffer
+	cmd := s.d.Command(e, "sh", "-c", "sleep 1; stty size; echo err >&2")
+	cmd.Stdout = &out
+	c.Assert(cmd.Start(), IsNil)
+	c.Assert(cmd.Resize(40, 100), IsNil)
+	c.Assert(cmd.Wait(), IsNil)
+	c.Assert(out.String(), Equals, "40 100\r\nerr\r\n")
+}
+
+func (s *CmdTestSuite) TestTtyExec(c *C) {
+	e, err := dexec.ByExecInContainer(s.runningContainer(c), dexec.ExecOption{Tty: true})
+	c.Assert(err, IsNil)
+	var out bytes.Buffer
+	cmd := s.d.Command(e, "sh", "-c", "sleep 1; stty size")
+	cmd.Stdout = &out
+	c.Assert(cmd.Start(), IsNil)
+	c.Assert(cmd.Resize(25, 80), IsNil)
+	c.Assert(cmd.Wait(), IsNil)
+	c.Assert(out.String(), Equals, "25 80\r\n")
+}
+
+func (s *CmdTestSuite) TestResizeNotStarted(c *C) {
+	cmd := s.d.Command(baseContainer(c), "true")
+	c.Assert(cmd.Resize(25, 80), Equals, dexec.ErrNotStarted)
+}
+
+func (s *CmdTestSuite) TestNoOutputLost(c *C) {
+	if testing.Short() {
+		c.Skip("runs thousands of containers")
+	}
+	const n, workers = 2000, 16
+	// c.Assert must not be called by the workers
+	executions := make([]dexec.Execution, n)
+	for i := range executions {
+		executions[i] = baseContainer(c)
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				// no trailing newline and an immediate exit
+				cmd := s.d.Command(executions[i], "sh", "-c", `printf "$0"; printf "$0" >&2; cat`, strconv.Itoa(i))
+				cmd.Stdin = strings.NewReader("-in")
+				var stdout, stderr bytes.Buffer
+				cmd.Stdout, cmd.Stderr = &stdout, &stderr
+				c.Check(cmd.Run(), IsNil)
+				c.Check(stdout.String(), Equals, strconv.Itoa(i)+"-in")
+				c.Check(stderr.String(), Equals, strconv.Itoa(i))
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+func (s *CmdTestSuite) TestStdinReadError(c *C) {
+	errBroken := errors.New("broken source")
+	cmd := s.d.Command(baseContainer(c), "sh", "-c", "cat; sleep 10")
+	cmd.Stdin = io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errBroken))
+	start := time.Now()
+	err := cmd.Run()
+	c.Assert(time.Since(start) < 10*time.Second, Equals, true) // killed
+
+	var pe *dexec.PhaseError
+	c.Assert(errors.As(err, &pe), Equals, true)
+	c.Assert(pe.Phase, Equals, dexec.PhaseStdin)
+	c.Assert(errors.Is(err, errBroken), Equals, true)
+}
+
+func (s *CmdTestSuite) TestStdinNotReadIgnored(c *C) {
+	cmd := s.d.Command(baseContainer(c), "true")
+	cmd.Stdin = bytes.NewReader(make([]byte, 8<<20))
+	c.Assert(cmd.Run(), IsNil)
+}
+
+func (s *CmdTestSuite) TestRunTimeout(c *C) {
+	cmd := s.d.Command(baseContainer(c), "sleep", "30")
+	cmd.Timeouts.Run = time.Second
+	cmd.StopTimeout = time.Second
+	start := time.Now()
+	err := cmd.Run()
+	c.Assert(time.Since(start) < 10*time.Second, Equals, true)
+	c.Assert(errors.Is(err, context.DeadlineExceeded), Equals, true)
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+}
+
+func (s *CmdTestSuite) TestCreateTimeout(c *C) {
+	cmd := s.d.Command(baseContainer(c), "true")
+	cmd.Timeouts.Create = time.Nanosecond
+	c.Assert(errors.Is(cmd.Run(), context.DeadlineExceeded), Equals, true)
+}
+
+func (s *CmdTestSuite) TestWaitDelay(c *C) {
+	e, err := dexec.ByExecInContainer(s.runningContainer(c), dexec.ExecOption{})
+	c.Assert(err, IsNil)
+	// the background process keeps the output open after the command exits
+	cmd := s.d.Command(e, "sh", "-c", "sleep 30 & echo hi")
+	cmd.WaitDelay = 500 * time.Millisecond
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	c.Assert(cmd.Run(), Equals, dexec.ErrWaitDelay)
+	c.Assert(cmd.ProcessState.Success(), Equals, true)
+	c.Assert(out.String(), Equals, "hi\n")
+}
+
+func (s *CmdTestSuite) TestCancel(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cmd := s.d.CommandContext(ctx, baseContainer(c), "sh", "-c", "trap 'exit 0' INT; while true; do sleep .1; done")
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	c.Assert(cmd.Start(), IsNil)
+	time.Sleep(time.Second)
+	cancel()
+	// the command exited successfully, so the context error is reported
+	c.Assert(cmd.Wait(), Equals, context.Canceled)
+	c.Assert(cmd.ProcessState.Success(), Equals, true)
+}
+
+func (s *CmdTestSuite) TestCancelIgnoredWaitDelay(c *C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cmd := s.d.CommandContext(ctx, baseContainer(c), "sh", "-c", "trap '' INT; sleep 60")
+	cmd.Cancel = func() error { return cmd.Process.Signal(os.Interrupt) }
+	cmd.WaitDelay = time.Second
+	c.Assert(cmd.Start(), IsNil)
+	cancel()
+	start := time.Now()
+	err := cmd.Wait()
+	c.Assert(time.Since(start) < 30*time.Second, Equals, true)
+	c.Assert(errors.Is(err, context.Canceled), Equals, true)
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+	c.Assert(err.(*dexec.ExitError).Signal, Equals, syscall.SIGKILL)
+}
+
+func (s *CmdTestSuite) TestRetention(c *C) {
+	for _, t := range []struct {
+		policy  dexec.RetentionPolicy
+		command string
+		kept    bool
+	}{
+		{dexec.RemoveAlways, "false", false},
+		{dexec.KeepOnFailure, "true", false},
+		{dexec.KeepOnFailure, "false", true},
+		{dexec.KeepAlways, "true", true},
+	} {
+		e, err := dexec.ByCreatingContainer(dexec.CreateContainerOption{
+			Config:       &containertypes.Config{Image: "busybox"},
+			Retention:    t.policy,
+			RetentionTTL: time.Second,
+		})
+		c.Assert(err, IsNil)
+		cmd := s.d.Command(e, t.command)
+		cmd.Run()
+		id := cmd.ProcessState.ContainerID()
+
+		info, err := s.d.ContainerInspect(context.Background(), id)
+		if !t.kept {
+			c.Assert(docker.IsErrNotFound(err), Equals, true)
+			continue
+		}
+		c.Assert(err, IsNil)
+		c.Assert(info.State.Running, Equals, false)
+		c.Assert(info.Config.Labels[dexec.LabelRetentionTTL], Equals, "1")
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	removed, err := s.d.SweepRetained(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(len(removed) >= 2, Equals, true)
+}
+
+func (s *CmdTestSuite) TestOwnerLabels(c *C) {
+	e, err := dexec.ByCreatingContainer(dexec.CreateContainerOption{
+		Config:    &containertypes.Config{Image: "busybox", Labels: map[string]string{"app": "test"}},
+		JobID:     "job-1",
+		Retention: dexec.KeepAlways,
+	})
+	c.Assert(err, IsNil)
+	cmd := s.d.Command(e, "true")
+	c.Assert(cmd.Run(), IsNil)
+	id := cmd.ProcessState.ContainerID()
+	defer s.d.ContainerRemove(context.Background(), id, types.ContainerRemoveOptions{Force: true})
+
+	info, err := s.d.ContainerInspect(context.Background(), id)
+	c.Assert(err, IsNil)
+	labels := info.Config.Labels
+	c.Assert(labels["app"], Equals, "test")
+	c.Assert(labels[dexec.LabelManaged], Equals, "true")
+	c.Assert(labels[dexec.LabelOwnerPID], Equals, strconv.Itoa(os.Getpid()))
+	c.Assert(labels[dexec.LabelJobID], Equals, "job-1")
+	_, err = time.Parse(time.RFC3339, labels[dexec.LabelCreated])
+	c.Assert(err, IsNil)
+}
+
+func (s *CmdTestSuite) TestReap(c *C) {
+	host, _ := os.Hostname()
+	job := "reap-" + testContainer()
+	create := func(pid string) string {
+		resp, err := s.d.ContainerCreate(context.Background(), &containertypes.Config{
+			Image: "busybox",
+			Labels: map[string]string{
+				dexec.LabelManaged:   "true",
+				dexec.LabelOwnerHost: host,
+				dexec.LabelOwnerPID:  pid,
+				dexec.LabelCreated:   time.Now().UTC().Format(time.RFC3339),
+				dexec.LabelJobID:     job,
+			},
+		}, nil, nil, "")
+		c.Assert(err, IsNil)
+		return resp.ID
+	}
+	orphan := create("999999") // beyond the default pid_max
+	alive := create(strconv.Itoa(os.Getpid()))
+	defer s.d.ContainerRemove(context.Background(), alive, types.ContainerRemoveOptions{Force: true})
+
+	removed, err := s.d.Reap(context.Background(), dexec.ReapFilter{Orphans: true, JobID: job})
+	c.Assert(err, IsNil)
+	c.Assert(removed, DeepEquals, []string{orphan})
+
+	removed, err = s.d.Reap(context.Background(), dexec.ReapFilter{MaxAge: time.Nanosecond, JobID: job})
+	c.Assert(err, IsNil)
+	c.Assert(removed, DeepEquals, []string{alive})
+}
@@ -0,0 +1,75 @@
+package dexec
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/docker/docker/api/types"
+)
+
+// CommitOption describes the image created from the container of a command
+// that exited successfully.
+//
+// The entrypoint of the image is the command that was run, as the container
+// was created with it; override it with Changes if the image is meant to be
+// run by other means than dexec.
+type CommitOption struct {
+	// Repo and Tag name the image. The image is left untagged if Repo is
+	// empty, and is tagged "latest" if Tag is empty.
+	Repo string
+	Tag  string
+
+	Comment string
+	Author  string
+
+	// Labels are added to the labels of the image. The labels set by dexec
+	// on its containers, such as LabelManaged, are cleared.
+	Labels map[string]string
+
+	// Changes are Dockerfile instructions applied to the image, such as
+	// "ENV PATH=/opt/bin:$PATH" or `CMD ["sh"]`.
+	Changes []string
+}
+
+func (o *CommitOption) reference() string {
+	if o.Repo == "" {
+		return ""
+	}
+	tag := o.Tag
+	if tag == "" {
+		tag = "latest"
+	}
+	return o.Repo + ":" + tag
+}
+
+// managedLabels are the labels set by dexec on its containers. They are
+// cleared in the committed image, or the containers started from it would be
+// taken by Reap and SweepRetained for containers of dexec. The engine adds the
+// labels of the container missing from the image, so they cannot be removed.
+var managedLabels = []string{LabelManaged, LabelOwnerHost, LabelOwnerPID, LabelCreated, LabelJobID, LabelRetentionTTL}
+
+func (o *CommitOption) changes() []string {
+	keys := sortedKeys(o.Labels)
+	changes := make([]string, 0, len(managedLabels)+len(keys)+len(o.Changes))
+	for _, k := range managedLabels {
+		changes = append(changes, "LABEL "+strconv.Quote(k)+`=""`)
+	}
+	for _, k := range keys {
+		changes = append(changes, "LABEL "+strconv.Quote(k)+"="+strconv.Quote(o.Labels[k]))
+	}
+	return append(changes, o.Changes...)
+}
+
+// commitContainer creates an image from the container and returns its ID.
+func commitContainer(ctx context.Context, d Docker, id string, opt *CommitOption) (string, error) {
+	resp, err := d.Client.ContainerCommit(ctx, id, types.ContainerCommitOptions{
+		Reference: opt.reference(),
+		Comment:   opt.Comment,
+		Author:    opt.Author,
+		Changes:   opt.changes(),
+	})
+	if err != nil {
+		return "", &PhaseError{Phase: PhaseCommit, ContainerID: id, Err: err}
+	}
+	return resp.ID, nil
+}
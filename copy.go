@@ -0,0 +1,384 @@
+package dexec
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	types "github.com/docker/docker/api/types"
+)
+
+// FileCopier is implemented by executions that can copy files into and out of
+// the container of the command. Cmd uses it for Cmd.Inputs and Cmd.Outputs.
+type FileCopier interface {
+	// CopyTo extracts the tar archive into the directory dst in the
+	// container. Missing parent directories of the entries are created.
+	CopyTo(ctx context.Context, d Docker, dst string, archive io.Reader) error
+
+	// CopyFrom returns a tar archive of the file or directory src in the
+	// container. The names of the entries start with the base name of src.
+	CopyFrom(ctx context.Context, d Docker, src string) (io.ReadCloser, error)
+}
+
+// Input is content copied into the container after it is created and before
+// the command starts. Exactly one of HostPath, Files and Archive must be set.
+type Input struct {
+	// Dest is the absolute path of the directory the content is placed in.
+	// It is created if it does not exist.
+	Dest string
+
+	// HostPath is a file or a directory on the host. A file is placed in
+	// Dest with the same name, the contents of a directory are placed in
+	// Dest.
+	HostPath string
+
+	// Files maps slash-separated paths relative to Dest to file contents.
+	Files map[string][]byte
+
+	// Archive is a tar stream extracted into Dest.
+	Archive io.Reader
+}
+
+// Output selects files that are copied out of the container after the command
+// exits. Exactly one of HostDir and Archive must be set.
+type Output struct {
+	// Pattern is the absolute path of the files in the container. Its
+	// elements may contain the wildcards of path.Match, such as
+	// "/out/*.pdf". Matched directories are copied with their contents.
+	Pattern string
+
+	// HostDir is the directory on the host the matched files are written
+	// to. The files keep their paths relative to the directory of the first
+	// element of Pattern with a wildcard, or relative to the parent of
+	// Pattern if it has none. Existing files and symbolic links are
+	// replaced, and the symbolic links under HostDir are not followed.
+	HostDir string
+
+	// Archive receives the matched files as a tar stream, named with the
+	// same relative paths.
+	Archive io.Writer
+}
+
+// archive returns the tar stream of the input, written by a goroutine that
+// ends once the stream is read or the returned reader is closed.
+func (in Input) archive() (*io.PipeReader, error) {
+	if !path.IsAbs(in.Dest) {
+		return nil, fmt.Errorf("dexec: Input.Dest %q is not absolute", in.Dest)
+	}
+	prefix := strings.TrimPrefix(path.Clean(in.Dest), "/")
+
+	var write func(tw *tar.Writer) error
+	switch {
+	case in.HostPath != "" && in.Files == nil && in.Archive == nil:
+		write = func(tw *tar.Writer) error { return writeHostPath(tw, in.HostPath, prefix) }
+	case in.HostPath == "" && in.Files != nil && in.Archive == nil:
+		write = func(tw *tar.Writer) error { return writeFiles(tw, in.Files, prefix) }
+	case in.HostPath == "" && in.Files == nil && in.Archive != nil:
+		write = func(tw *tar.Writer) error { return rebaseArchive(tw, in.Archive, prefix) }
+	default:
+		return nil, errors.New("dexec: exactly one of Input.HostPath, Input.Files and Input.Archive must be set")
+	}
+
+	// the archive is extracted at "/" with the entries prefixed by Dest, so
+	// that the missing directories of Dest are created by the engine.
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := write(tw)
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+func writeFiles(tw *tar.Writer, files map[string][]byte, prefix string) error {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		hdr := &tar.Header{
+			Name:     path.Join(prefix, path.Clean("/"+name)),
+			Mode:     0644,
+			Size:     int64(len(files[name])),
+			Typeflag: tar.TypeReg,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(files[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeHostPath(tw *tar.Writer, hostPath, prefix string) error {
+	fi, err := os.Stat(hostPath)
+	if err != nil {
+		return err
+	}
+	root := hostPath
+	if !fi.IsDir() {
+		root = filepath.Dir(hostPath)
+	}
+	return filepath.Walk(hostPath, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		var link string
+		if fi.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(p); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(fi, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(prefix, filepath.ToSlash(rel))
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
+
+func rebaseArchive(tw *tar.Writer, r io.Reader, prefix string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(prefix, path.Clean("/"+hdr.Name))
+		if hdr.Typeflag == tar.TypeLink {
+			hdr.Linkname = path.Join(prefix, path.Clean("/"+hdr.Linkname))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func hasMeta(s string) bool { return strings.ContainsAny(s, `*?[\`) }
+
+// patternBase returns the directory the paths matched by pattern are relative
+// to.
+func patternBase(pattern string) string {
+	elems := strings.Split(pattern, "/")
+	for i, e := range elems {
+		if hasMeta(e) {
+			if i <= 1 {
+				return "/"
+			}
+			return strings.Join(elems[:i], "/")
+		}
+	}
+	return path.Dir(pattern)
+}
+
+// matchOutput reports whether the path p in the container or one of its
+// parent directories matches the pattern.
+func matchOutput(pattern, p string) bool {
+	for ; p != "/" && p != "."; p = path.Dir(p) {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// collect copies the files matching the output out of the container.
+func (out Output) collect(ctx context.Context, d Docker, fc FileCopier) error {
+	if (out.HostDir == "") == (out.Archive == nil) {
+		return errors.New("dexec: exactly one of Output.HostDir and Output.Archive must be set")
+	}
+	if !path.IsAbs(out.Pattern) {
+		return fmt.Errorf("dexec: Output.Pattern %q is not absolute", out.Pattern)
+	}
+	pattern := path.Clean(out.Pattern)
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("dexec: invalid Output.Pattern %q: %w", out.Pattern, err)
+	}
+	base := patternBase(pattern)
+
+	// copy the whole base directory and filter it, as the engine does not
+	// support wildcards
+	src := base
+	if !hasMeta(pattern) {
+		src = pattern
+	}
+	rc, err := fc.CopyFrom(ctx, d, src)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var tw *tar.Writer
+	if out.Archive != nil {
+		tw = tar.NewWriter(out.Archive)
+	}
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		p := path.Join(path.Dir(src), hdr.Name)
+		if !matchOutput(pattern, p) {
+			continue
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(p, base), "/")
+		if rel == "" {
+			continue
+		}
+		if tw != nil {
+			hdr.Name = rel
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := extractEntry(out.HostDir, filepath.FromSlash(rel), hdr, tr); err != nil {
+			return err
+		}
+	}
+	if tw != nil {
+		return tw.Close()
+	}
+	return nil
+}
+
+// extractEntry writes the entry to the path rel of dir. The symbolic links
+// under dir, which may come from the container, are never followed: they
+// could point outside of dir.
+func extractEntry(dir, rel string, hdr *tar.Header, r io.Reader) error {
+	if err := mkdirInside(dir, filepath.Dir(rel), 0755); err != nil {
+		return err
+	}
+	dst := filepath.Join(dir, rel)
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		return mkdirInside(dir, rel, os.FileMode(hdr.Mode).Perm())
+	case tar.TypeSymlink:
+		if err := removeFile(dst); err != nil {
+			return err
+		}
+		return os.Symlink(hdr.Linkname, dst)
+	case tar.TypeReg, tar.TypeRegA:
+		if err := removeFile(dst); err != nil {
+			return err
+		}
+		f, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, os.FileMode(hdr.Mode).Perm())
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(f, r); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+	return nil // devices, fifos and hard links are skipped
+}
+
+// mkdirInside creates the directory rel of dir and its missing parents. It
+// fails on a symbolic link rather than following it.
+func mkdirInside(dir, rel string, perm os.FileMode) error {
+	p := dir
+	for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+		if elem == "" || elem == "." {
+			continue
+		}
+		p = filepath.Join(p, elem)
+		fi, err := os.Lstat(p)
+		switch {
+		case os.IsNotExist(err):
+			if err := os.Mkdir(p, perm); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case fi.Mode()&os.ModeSymlink != 0:
+			return fmt.Errorf("dexec: refusing to extract through the symbolic link %s", p)
+		case !fi.IsDir():
+			return fmt.Errorf("dexec: %s is not a directory", p)
+		}
+	}
+	return nil
+}
+
+// removeFile removes the file or symbolic link name, if any, so that it is
+// replaced rather than written through.
+func removeFile(name string) error {
+	fi, err := os.Lstat(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		return fmt.Errorf("dexec: %s is a directory", name)
+	}
+	return os.Remove(name)
+}
+
+// copyToContainer and copyFromContainer implement FileCopier for the
+// executions running in a container.
+func copyToContainer(ctx context.Context, d Docker, id, dst string, archive io.Reader) error {
+	if id == "" {
+		return ErrNotCreated
+	}
+	if err := d.Client.CopyToContainer(ctx, id, dst, archive, types.CopyToContainerOptions{}); err != nil {
+		return &PhaseError{Phase: PhaseCopy, ContainerID: id, Err: err}
+	}
+	return nil
+}
+
+func copyFromContainer(ctx context.Context, d Docker, id, src string) (io.ReadCloser, error) {
+	if id == "" {
+		return nil, ErrNotCreated
+	}
+	rc, _, err := d.Client.CopyFromContainer(ctx, id, src)
+	if err != nil {
+		return nil, &PhaseError{Phase: PhaseCopy, ContainerID: id, Err: err}
+	}
+	return rc, nil
+}
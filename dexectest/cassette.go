@@ -0,0 +1,463 @@
+package dexectest
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+
+	types "github.com/docker/docker/api/types"
+	dexec "github.com/silentred/go-dexec"
+)
+
+// Cassette is a recording of the requests of a Docker client to a Docker
+// engine and of the responses, made by the Server of Record and played back
+// by the Server of Replay.
+//
+// A Server is used rather than a transport of the Docker client because the
+// client dials the hijacked connections of attach requests itself.
+type Cassette struct {
+	mu           sync.Mutex
+	Interactions []*Interaction `json:"interactions"`
+}
+
+// Interaction is a request and its response. The body of the response of a
+// hijacked connection is the output of the stream, and Stdin is the standard
+// input sent by the client on it.
+type Interaction struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	RequestBody []byte      `json:"request_body,omitempty"`
+	Stdin       []byte      `json:"stdin,omitempty"`
+	Status      int         `json:"status"`
+	Header      http.Header `json:"header"`
+	Body        []byte      `json:"body,omitempty"`
+}
+
+// LoadCassette reads a cassette saved to file.
+func LoadCassette(file string) (*Cassette, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	c := new(Cassette)
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("dexectest: cassette %s: %w", file, err)
+	}
+	return c, nil
+}
+
+// Save writes the interactions recorded so far to file.
+func (c *Cassette) Save(file string) error {
+	c.mu.Lock()
+	b, err := json.MarshalIndent(c, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, b, 0644)
+}
+
+func (c *Cassette) add(it *Interaction) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Interactions = append(c.Interactions, it)
+}
+
+// interactionWriter appends to the body of the response of an interaction
+// being recorded, or to its standard input.
+type interactionWriter struct {
+	c     *Cassette
+	it    *Interaction
+	stdin bool
+}
+
+func (w *interactionWriter) Write(b []byte) (int, error) {
+	w.c.mu.Lock()
+	defer w.c.mu.Unlock()
+	if w.stdin {
+		w.it.Stdin = append(w.it.Stdin, b...)
+	} else {
+		w.it.Body = append(w.it.Body, b...)
+	}
+	return len(b), nil
+}
+
+// Record starts a Server that forwards the requests to the Docker engine at
+// host, such as "unix:///var/run/docker.sock" or "tcp://127.0.0.1:2375", and
+// records them to cassette. TLS is not supported.
+func Record(host string, cassette *Cassette) (*Server, error) {
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	network, addr := u.Scheme, u.Host
+	switch network {
+	case "unix":
+		addr = u.Path
+	case "tcp":
+	default:
+		return nil, fmt.Errorf("dexectest: unsupported Docker host %s", host)
+	}
+	rec := &recorder{
+		cassette: cassette,
+		dial: func(ctx context.Context) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}
+	rec.transport = &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return rec.dial(ctx)
+		},
+		DisableCompression: true,
+	}
+	return &Server{Server: httptest.NewServer(rec)}, nil
+}
+
+type recorder struct {
+	cassette  *Cassette
+	dial      func(ctx context.Context) (net.Conn, error)
+	transport *http.Transport
+}
+
+func (rec *recorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	it := &Interaction{Method: r.Method, URL: r.URL.RequestURI(), RequestBody: body}
+	rec.cassette.add(it)
+	record := &interactionWriter{c: rec.cassette, it: it}
+
+	out := r.Clone(r.Context())
+	out.URL.Scheme, out.URL.Host, out.Host = "http", "docker", "docker"
+	out.RequestURI = ""
+	out.Body, out.ContentLength = http.NoBody, int64(len(body))
+	if len(body) > 0 {
+		out.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	if r.Header.Get("Upgrade") != "" {
+		rec.hijack(w, out, record)
+		return
+	}
+	resp, err := rec.transport.RoundTrip(out)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer resp.Body.Close()
+	rec.respond(w, resp, record)
+}
+
+// respond copies the response, flushing as it comes so that the headers of
+// the wait endpoint are sent before the container exits.
+func (rec *recorder) respond(w http.ResponseWriter, resp *http.Response, record *interactionWriter) {
+	rec.cassette.mu.Lock()
+	record.it.Status, record.it.Header = resp.StatusCode, resp.Header.Clone()
+	rec.cassette.mu.Unlock()
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	w.(http.Flusher).Flush()
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			record.Write(buf[:n])
+			w.Write(buf[:n])
+			w.(http.Flusher).Flush()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// hijack sends the attach request on a connection of its own, and pipes the
+// streams between it and the connection of the client once upgraded.
+func (rec *recorder) hijack(w http.ResponseWriter, out *http.Request, record *interactionWriter) {
+	up, err := rec.dial(out.Context())
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	br := bufio.NewReader(up)
+	resp, err := sendRequest(up, br, out)
+	if err != nil {
+		up.Close()
+		writeError(w, err)
+		return
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		defer up.Close()
+		defer resp.Body.Close()
+		rec.respond(w, resp, record)
+		return
+	}
+	rec.cassette.mu.Lock()
+	record.it.Status, record.it.Header = resp.StatusCode, resp.Header.Clone()
+	rec.cassette.mu.Unlock()
+
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		up.Close()
+		writeError(w, err)
+		return
+	}
+	writeHead(rw.Writer, resp.StatusCode, resp.Status, resp.Header)
+	if err := rw.Flush(); err != nil {
+		up.Close()
+		conn.Close()
+		return
+	}
+	stdin := &interactionWriter{c: rec.cassette, it: record.it, stdin: true}
+	go pipe(conn, bufio.NewReader(io.TeeReader(rw.Reader, stdin)), types.HijackedResponse{
+		Conn:   up,
+		Reader: bufio.NewReader(io.TeeReader(br, record)),
+	})
+}
+
+func sendRequest(conn net.Conn, br *bufio.Reader, req *http.Request) (*http.Response, error) {
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(br, req)
+}
+
+// Replay starts a Server that responds to the requests with the interactions
+// of cassette. A request is matched with the first interaction not yet played
+// with the same method and URL. Its body must be the recorded one but for the
+// values that change from a run to another: the labels of dexec holding the
+// host, the pid and the time, the ExecEnv variables of the exec instances, and
+// the times and owners of the files of tar archives. Otherwise the request
+// fails, and so does Err of the Server. The streams of hijacked connections are
+// written at once, and the standard input is then read until the client closes
+// the connection and compared with the recorded one, the difference being
+// reported by Err.
+func Replay(cassette *Cassette) *Server {
+	rp := &replayer{
+		cassette: cassette,
+		played:   make(map[*Interaction]bool),
+		tokens:   make(map[string]string),
+	}
+	return &Server{Server: httptest.NewServer(rp), replayer: rp}
+}
+
+// Err returns the first difference between the requests to a Server of Replay
+// and the interactions of its cassette, once the client closed the hijacked
+// connections. It returns nil for the other servers.
+func (s *Server) Err() error {
+	if s.replayer == nil {
+		return nil
+	}
+	s.replayer.streams.Wait()
+	s.replayer.cassette.mu.Lock()
+	defer s.replayer.cassette.mu.Unlock()
+	return s.replayer.err
+}
+
+type replayer struct {
+	cassette *Cassette
+	streams  sync.WaitGroup // the hijacked connections being played
+
+	// guarded by the lock of cassette
+	played map[*Interaction]bool
+	tokens map[string]string // ExecEnv values replayed to the recorded ones
+	err    error
+}
+
+func (rp *replayer) next(r *http.Request) *Interaction {
+	rp.cassette.mu.Lock()
+	defer rp.cassette.mu.Unlock()
+	for _, it := range rp.cassette.Interactions {
+		if !rp.played[it] && it.Method == r.Method && it.URL == r.URL.RequestURI() {
+			rp.played[it] = true
+			return it
+		}
+	}
+	return nil
+}
+
+func (rp *replayer) fail(err error) {
+	rp.cassette.mu.Lock()
+	defer rp.cassette.mu.Unlock()
+	if rp.err == nil {
+		rp.err = err
+	}
+}
+
+func (rp *replayer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	it := rp.next(r)
+	if it == nil {
+		err := fmt.Errorf("dexectest: no interaction recorded for %s %s", r.Method, r.URL.RequestURI())
+		rp.fail(err)
+		writeError(w, err)
+		return
+	}
+	if !rp.sameBody(r.Header.Get("Content-Type"), it.RequestBody, body) {
+		err := fmt.Errorf("dexectest: body of %s %s differs from the recorded one: %s, recorded %s",
+			r.Method, r.URL.RequestURI(), bytes.TrimSpace(body), bytes.TrimSpace(it.RequestBody))
+		rp.fail(err)
+		writeError(w, err)
+		return
+	}
+	if it.Status != http.StatusSwitchingProtocols {
+		for k, v := range it.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(it.Status)
+		w.Write(it.Body)
+		return
+	}
+
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	rp.streams.Add(1)
+	defer rp.streams.Done()
+	defer conn.Close()
+	writeHead(rw.Writer, it.Status, "", it.Header)
+	rw.Write(it.Body)
+	if err := rw.Flush(); err != nil {
+		return
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	// the client may close the connection rather than its write side
+	stdin, _ := io.ReadAll(rw)
+	if !bytes.Equal(stdin, it.Stdin) {
+		rp.fail(fmt.Errorf("dexectest: standard input of %s %s differs from the recorded one: %q, recorded %q",
+			r.Method, r.URL.RequestURI(), stdin, it.Stdin))
+	}
+}
+
+// volatileLabels are the labels of dexec whose values change from a run to
+// another.
+var volatileLabels = []string{dexec.LabelOwnerHost, dexec.LabelOwnerPID, dexec.LabelCreated}
+
+var execEnv = regexp.MustCompile(dexec.ExecEnv + `=([0-9a-f]+)`)
+
+// sameBody reports whether the body of a request is the recorded one but for
+// the values that change from a run to another.
+func (rp *replayer) sameBody(contentType string, recorded, body []byte) bool {
+	if bytes.Equal(recorded, body) {
+		return true
+	}
+	switch {
+	case strings.HasPrefix(contentType, "application/json"):
+		return reflect.DeepEqual(jsonBody(recorded), jsonBody(rp.replaceTokens(recorded, body)))
+	case strings.HasPrefix(contentType, "application/x-tar"):
+		a, err := tarEntries(recorded)
+		if err != nil {
+			return false
+		}
+		b, err := tarEntries(body)
+		return err == nil && reflect.DeepEqual(a, b)
+	}
+	return false
+}
+
+// replaceTokens replaces in body the ExecEnv values of the exec instances
+// created by the replayed requests with the recorded ones, so that they match
+// the requests signalling them as well.
+func (rp *replayer) replaceTokens(recorded, body []byte) []byte {
+	rp.cassette.mu.Lock()
+	defer rp.cassette.mu.Unlock()
+	if a, b := execEnv.FindSubmatch(recorded), execEnv.FindSubmatch(body); a != nil && b != nil {
+		rp.tokens[string(b[1])] = string(a[1])
+	}
+	for replayed, token := range rp.tokens {
+		body = bytes.ReplaceAll(body, []byte(replayed), []byte(token))
+	}
+	return body
+}
+
+// jsonBody decodes a JSON body without the volatile labels.
+func jsonBody(b []byte) interface{} {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return string(b)
+	}
+	stripLabels(v)
+	return v
+}
+
+func stripLabels(v interface{}) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if labels, ok := e.(map[string]interface{}); ok && k == "Labels" {
+				for _, l := range volatileLabels {
+					delete(labels, l)
+				}
+			}
+			stripLabels(e)
+		}
+	case []interface{}:
+		for _, e := range v {
+			stripLabels(e)
+		}
+	}
+}
+
+// tarEntry is an entry of a tar archive without its times and owner.
+type tarEntry struct {
+	Name     string
+	Typeflag byte
+	Linkname string
+	Mode     int64
+	Body     string
+}
+
+func tarEntries(b []byte) ([]tarEntry, error) {
+	var entries []tarEntry
+	tr := tar.NewReader(bytes.NewReader(b))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, tarEntry{hdr.Name, hdr.Typeflag, hdr.Linkname, hdr.Mode, string(body)})
+	}
+}
+
+// writeHead writes the status line and the headers of a response.
+func writeHead(w io.Writer, code int, status string, header http.Header) {
+	if status == "" {
+		status = fmt.Sprintf("%d %s", code, http.StatusText(code))
+	}
+	fmt.Fprintf(w, "HTTP/1.1 %s\r\n", status)
+	header.Write(w)
+	io.WriteString(w, "\r\n")
+}
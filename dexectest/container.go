@@ -0,0 +1,576 @@
+package dexectest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	types "github.com/docker/docker/api/types"
+	containertypes "github.com/docker/docker/api/types/container"
+	networktypes "github.com/docker/docker/api/types/network"
+)
+
+// Container states, as reported by the Docker API.
+const (
+	stateCreated = "created"
+	stateRunning = "running"
+	stateExited  = "exited"
+)
+
+// defaultStopTimeout is how long ContainerStop waits by default before
+// killing the command, like the Docker engine.
+const defaultStopTimeout = 10 * time.Second
+
+type container struct {
+	id         string
+	name       string
+	args       []string
+	config     containertypes.Config
+	hostConfig containertypes.HostConfig
+	image      *image
+	created    time.Time
+	fs         *memFS
+	base       *memFS // filesystem of the image
+
+	state      string
+	exitCode   int
+	startedAt  time.Time
+	finishedAt time.Time
+	proc       *process
+	conn       *hijackConn // attached connection for the next start
+	attach     types.ContainerAttachOptions
+	done       chan struct{} // closed when the command exits
+	removed    chan struct{}
+}
+
+func (c *Client) containerLocked(ref string) (*container, error) {
+	if ctr, ok := c.containers[ref]; ok {
+		return ctr, nil
+	}
+	var found *container
+	for id, ctr := range c.containers {
+		if ctr.name == strings.TrimPrefix(ref, "/") {
+			return ctr, nil
+		}
+		if ref != "" && strings.HasPrefix(id, ref) {
+			if found != nil {
+				return nil, fmt.Errorf("Multiple IDs found with provided prefix: %s", ref)
+			}
+			found = ctr
+		}
+	}
+	if found == nil {
+		return nil, notFoundError{"No such container: " + ref}
+	}
+	return found, nil
+}
+
+func (c *Client) ContainerCreate(ctx context.Context, config *containertypes.Config, hostConfig *containertypes.HostConfig, networkingConfig *networktypes.NetworkingConfig, containerName string) (containertypes.ContainerCreateCreatedBody, error) {
+	var resp containertypes.ContainerCreateCreatedBody
+	if config == nil {
+		return resp, invalidParameterError{"config cannot be empty in order to create a container"}
+	}
+	args := append(append([]string(nil), config.Entrypoint...), config.Cmd...)
+	if len(args) == 0 {
+		return resp, invalidParameterError{"No command specified"}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	img, err := c.imageLocked(config.Image)
+	if err != nil {
+		return resp, err
+	}
+	// there are no networks other than the predefined ones
+	if hostConfig != nil {
+		switch mode := hostConfig.NetworkMode; {
+		case mode == "", mode.IsDefault(), mode.IsBridge(), mode.IsHost(), mode.IsNone(), mode.IsContainer():
+		default:
+			return resp, notFoundError{fmt.Sprintf("network %s not found", mode)}
+		}
+	}
+	id := newID()
+	name := strings.TrimPrefix(containerName, "/")
+	if name == "" {
+		name = "dexectest_" + id[:12]
+	}
+	for _, ctr := range c.containers {
+		if ctr.name == name {
+			return resp, conflictError{fmt.Sprintf("Conflict. The container name %q is already in use by container %q.", "/"+name, ctr.id)}
+		}
+	}
+
+	ctr := &container{
+		id:      id,
+		name:    name,
+		args:    args,
+		config:  *config,
+		image:   img,
+		created: time.Now(),
+		fs:      newMemFS(img.fs),
+		base:    img.fs,
+		state:   stateCreated,
+		done:    make(chan struct{}),
+		removed: make(chan struct{}),
+	}
+	// the labels of the image are inherited, like by the engine
+	ctr.config.Labels = copyLabels(img.labels)
+	for k, v := range config.Labels {
+		ctr.config.Labels[k] = v
+	}
+	if hostConfig != nil {
+		ctr.hostConfig = *hostConfig
+	}
+	c.containers[id] = ctr
+	resp.ID = id
+	return resp, nil
+}
+
+// ContainerStart runs the Program of the command of the container, with the
+// streams of the connection returned by the last ContainerAttach if any.
+func (c *Client) ContainerStart(ctx context.Context, container string, options types.ContainerStartOptions) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ctr, err := c.containerLocked(container)
+	if err != nil {
+		return err
+	}
+	switch ctr.state {
+	case stateRunning:
+		return nil
+	case stateExited:
+		ctr.done = make(chan struct{})
+	}
+
+	dir := ctr.config.WorkingDir
+	if dir == "" {
+		dir = "/"
+	}
+	ctr.state = stateRunning
+	ctr.startedAt = time.Now()
+	ctr.proc = c.startLocked(ctr, procSpec{
+		args:   ctr.args,
+		env:    ctr.config.Env,
+		dir:    dir,
+		tty:    ctr.config.Tty,
+		conn:   ctr.conn,
+		stdin:  ctr.attach.Stdin && ctr.config.OpenStdin,
+		stdout: ctr.attach.Stdout,
+		stderr: ctr.attach.Stderr,
+	}, func(code int) { c.exitedLocked(ctr, code) })
+	ctr.conn = nil
+	return nil
+}
+
+// exitedLocked records the exit of the command of the container, which kills
+// its exec instances.
+func (c *Client) exitedLocked(ctr *container, code int) {
+	ctr.state = stateExited
+	ctr.exitCode = code
+	ctr.finishedAt = time.Now()
+	for _, e := range c.execs {
+		if e.ctr == ctr && e.proc != nil {
+			c.signalLocked(e.proc, "SIGKILL")
+		}
+	}
+	close(ctr.done)
+	if ctr.hostConfig.AutoRemove {
+		c.removeLocked(ctr)
+	}
+}
+
+// ContainerAttach returns a connection to the standard streams of the
+// command. The command uses the streams of the last connection attached
+// before it starts; a connection attached to a running container only reads
+// EOF.
+func (c *Client) ContainerAttach(ctx context.Context, container string, options types.ContainerAttachOptions) (types.HijackedResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ctr, err := c.containerLocked(container)
+	if err != nil {
+		return types.HijackedResponse{}, err
+	}
+	conn := newHijackConn()
+	if ctr.state == stateRunning {
+		conn.hangUp()
+		return conn.response(), nil
+	}
+	if ctr.conn != nil {
+		ctr.conn.hangUp()
+	}
+	ctr.conn = conn
+	ctr.attach = options
+	return conn.response(), nil
+}
+
+func (c *Client) ContainerWait(ctx context.Context, container string, condition containertypes.WaitCondition) (<-chan containertypes.ContainerWaitOKBody, <-chan error) {
+	resultC := make(chan containertypes.ContainerWaitOKBody, 1)
+	errC := make(chan error, 1)
+
+	c.mu.Lock()
+	ctr, err := c.containerLocked(container)
+	if err != nil {
+		c.mu.Unlock()
+		errC <- err
+		return resultC, errC
+	}
+	wait := ctr.done
+	switch condition {
+	case containertypes.WaitConditionRemoved:
+		wait = ctr.removed
+	case containertypes.WaitConditionNextExit:
+	default:
+		if ctr.state != stateRunning {
+			wait = nil
+		}
+	}
+	c.mu.Unlock()
+
+	go func() {
+		if wait != nil {
+			select {
+			case <-wait:
+			case <-ctx.Done():
+				errC <- ctx.Err()
+				return
+			}
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		resultC <- containertypes.ContainerWaitOKBody{StatusCode: int64(ctr.exitCode)}
+	}()
+	return resultC, errC
+}
+
+func (c *Client) ContainerKill(ctx context.Context, container, signal string) error {
+	sig, err := parseSignal(signal)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ctr, err := c.containerLocked(container)
+	if err != nil {
+		return err
+	}
+	if ctr.state != stateRunning {
+		return conflictError{fmt.Sprintf("Container %s is not running", ctr.id)}
+	}
+	c.signalLocked(ctr.proc, sig)
+	return nil
+}
+
+// ContainerStop sends the stop signal of the container, SIGTERM by default,
+// and kills the command if it does not exit within the timeout.
+func (c *Client) ContainerStop(ctx context.Context, container string, timeout *time.Duration) error {
+	c.mu.Lock()
+	ctr, err := c.containerLocked(container)
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	if ctr.state != stateRunning {
+		c.mu.Unlock()
+		return nil
+	}
+	sig, err := parseSignal(ctr.config.StopSignal)
+	if ctr.config.StopSignal == "" || err != nil {
+		sig = "SIGTERM"
+	}
+	d := defaultStopTimeout
+	if timeout != nil {
+		d = *timeout
+	} else if ctr.config.StopTimeout != nil {
+		d = time.Duration(*ctr.config.StopTimeout) * time.Second
+	}
+	proc, done := ctr.proc, ctr.done
+	c.signalLocked(proc, sig)
+	c.mu.Unlock()
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-t.C:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	c.mu.Lock()
+	c.signalLocked(proc, "SIGKILL")
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Client) ContainerRemove(ctx context.Context, container string, options types.ContainerRemoveOptions) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ctr, err := c.containerLocked(container)
+	if err != nil {
+		return err
+	}
+	if ctr.state == stateRunning && !options.Force {
+		return conflictError{fmt.Sprintf("You cannot remove a running container %s. Stop the container before attempting removal or force remove", ctr.id)}
+	}
+	c.removeLocked(ctr)
+	return nil
+}
+
+func (c *Client) removeLocked(ctr *container) {
+	if _, ok := c.containers[ctr.id]; !ok {
+		return
+	}
+	delete(c.containers, ctr.id)
+	if ctr.state == stateRunning {
+		c.signalLocked(ctr.proc, "SIGKILL")
+	}
+	if ctr.conn != nil {
+		ctr.conn.hangUp()
+	}
+	for id, e := range c.execs {
+		if e.ctr == ctr {
+			delete(c.execs, id)
+		}
+	}
+	close(ctr.removed)
+}
+
+// formatTime formats the times of ContainerInspect the way the Docker API
+// does, including the zero time.
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func (c *Client) ContainerInspect(ctx context.Context, container string) (types.ContainerJSON, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ctr, err := c.containerLocked(container)
+	if err != nil {
+		return types.ContainerJSON{}, err
+	}
+	state := &types.ContainerState{
+		Status:     ctr.state,
+		Running:    ctr.state == stateRunning,
+		ExitCode:   ctr.exitCode,
+		StartedAt:  formatTime(ctr.startedAt),
+		FinishedAt: formatTime(ctr.finishedAt),
+	}
+	if state.Running {
+		state.Pid = ctr.proc.pid
+	}
+	config := ctr.config
+	hostConfig := ctr.hostConfig
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:         ctr.id,
+			Created:    formatTime(ctr.created),
+			Path:       ctr.args[0],
+			Args:       ctr.args[1:],
+			State:      state,
+			Image:      ctr.image.id,
+			Name:       "/" + ctr.name,
+			HostConfig: &hostConfig,
+		},
+		Config: &config,
+	}, nil
+}
+
+// ContainerList lists the containers, newest first. Only the "label" filter
+// is supported.
+func (c *Client) ContainerList(ctx context.Context, options types.ContainerListOptions) ([]types.Container, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var list []types.Container
+	for _, ctr := range c.containers {
+		if !options.All && ctr.state != stateRunning {
+			continue
+		}
+		if !matchLabels(ctr.config.Labels, options.Filters.Get("label")) {
+			continue
+		}
+		status := "Created"
+		switch ctr.state {
+		case stateRunning:
+			status = "Up"
+		case stateExited:
+			status = fmt.Sprintf("Exited (%d)", ctr.exitCode)
+		}
+		list = append(list, types.Container{
+			ID:      ctr.id,
+			Names:   []string{"/" + ctr.name},
+			Image:   ctr.config.Image,
+			ImageID: ctr.image.id,
+			Command: strings.Join(ctr.args, " "),
+			Created: ctr.created.Unix(),
+			Labels:  copyLabels(ctr.config.Labels),
+			State:   ctr.state,
+			Status:  status,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Created > list[j].Created })
+	if options.Limit > 0 && len(list) > options.Limit {
+		list = list[:options.Limit]
+	}
+	return list, nil
+}
+
+// matchLabels reports whether the labels match all the filters, of the form
+// "key" or "key=value".
+func matchLabels(labels map[string]string, filters []string) bool {
+	for _, f := range filters {
+		k, v, hasValue := strings.Cut(f, "=")
+		actual, ok := labels[k]
+		if !ok || hasValue && actual != v {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Client) ContainerResize(ctx context.Context, container string, options types.ResizeOptions) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ctr, err := c.containerLocked(container)
+	if err != nil {
+		return err
+	}
+	if ctr.state != stateRunning {
+		return conflictError{fmt.Sprintf("Container %s is not running", ctr.id)}
+	}
+	ctr.proc.resize(options.Height, options.Width)
+	return nil
+}
+
+func (c *Client) ContainerDiff(ctx context.Context, container string) ([]containertypes.ContainerChangeResponseItem, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ctr, err := c.containerLocked(container)
+	if err != nil {
+		return nil, err
+	}
+	return ctr.fs.diff(ctr.base), nil
+}
+
+// ContainerCommit creates an image with the filesystem and the labels of the
+// container. Of the configuration of the options, only the labels and the
+// LABEL instructions of the changes are applied. As by the engine, the labels
+// of the container missing from the result are added to it.
+func (c *Client) ContainerCommit(ctx context.Context, container string, options types.ContainerCommitOptions) (types.IDResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ctr, err := c.containerLocked(container)
+	if err != nil {
+		return types.IDResponse{}, err
+	}
+	labels := ctr.config.Labels
+	if options.Config != nil {
+		labels = options.Config.Labels
+	}
+	labels = copyLabels(labels)
+	for _, change := range options.Changes {
+		if err := applyLabel(labels, change); err != nil {
+			return types.IDResponse{}, invalidParameterError{err.Error()}
+		}
+	}
+	for k, v := range ctr.config.Labels {
+		if _, ok := labels[k]; !ok {
+			labels[k] = v
+		}
+	}
+	img := newImage(newMemFS(ctr.fs))
+	img.labels = labels
+	c.images[img.id] = img
+	if options.Reference != "" {
+		c.addImageLocked(options.Reference, img)
+	}
+	return types.IDResponse{ID: img.id}, nil
+}
+
+// applyLabel sets the labels of a LABEL instruction, such as
+// `LABEL a=b "c d"="e"`. The other instructions are ignored.
+func applyLabel(labels map[string]string, change string) error {
+	if !strings.HasPrefix(change, "LABEL ") {
+		return nil
+	}
+	rest := change[len("LABEL "):]
+	for rest = strings.TrimSpace(rest); rest != ""; rest = strings.TrimSpace(rest) {
+		k, r, err := labelWord(rest, "=")
+		if err != nil || !strings.HasPrefix(r, "=") {
+			return fmt.Errorf("invalid LABEL instruction: %s", change)
+		}
+		v, r, err := labelWord(r[1:], " ")
+		if err != nil {
+			return fmt.Errorf("invalid LABEL instruction: %s", change)
+		}
+		labels[k] = v
+		rest = r
+	}
+	return nil
+}
+
+// labelWord returns the quoted or unquoted word at the start of s, ending at
+// a character of stop, and the rest of s.
+func labelWord(s, stop string) (string, string, error) {
+	if strings.HasPrefix(s, `"`) {
+		q, err := strconv.QuotedPrefix(s)
+		if err != nil {
+			return "", "", err
+		}
+		w, err := strconv.Unquote(q)
+		return w, s[len(q):], err
+	}
+	i := strings.IndexAny(s, stop)
+	if i < 0 {
+		i = len(s)
+	}
+	return s[:i], s[i:], nil
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	l := make(map[string]string, len(labels))
+	for k, v := range labels {
+		l[k] = v
+	}
+	return l
+}
+
+func (c *Client) CopyToContainer(ctx context.Context, container, dstPath string, content io.Reader, options types.CopyToContainerOptions) error {
+	c.mu.Lock()
+	ctr, err := c.containerLocked(container)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return ctr.fs.extract(dstPath, content)
+}
+
+func (c *Client) CopyFromContainer(ctx context.Context, container, srcPath string) (io.ReadCloser, types.ContainerPathStat, error) {
+	var stat types.ContainerPathStat
+	c.mu.Lock()
+	ctr, err := c.containerLocked(container)
+	c.mu.Unlock()
+	if err != nil {
+		return nil, stat, err
+	}
+	archive, n, err := ctr.fs.archive(srcPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, stat, notFoundError{fmt.Sprintf("Could not find the file %s in container %s", srcPath, container)}
+	} else if err != nil {
+		return nil, stat, err
+	}
+	stat = types.ContainerPathStat{
+		Name:  path.Base(cleanPath(srcPath)),
+		Size:  int64(len(n.data)),
+		Mode:  n.mode,
+		Mtime: n.mtime,
+	}
+	return io.NopCloser(bytes.NewReader(archive)), stat, nil
+}
@@ -0,0 +1,274 @@
+// Package dexectest provides an in-memory Docker engine to test code that uses
+// dexec without a Docker engine.
+//
+// The engine implements dexec.Client. Instead of running images, it runs the
+// Programs registered for the names of the commands:
+//
+//	engine := dexectest.NewClient()
+//	engine.AddImage("busybox")
+//	engine.Handle("echo", dexectest.Script("hello\n", "", 0))
+//	d := dexec.Docker{Client: engine}
+//
+// Containers, exec instances, file copies, filesystem changes, commits and
+// signals are simulated; images are empty filesystems unless committed from a
+// container, and builds only tag an empty image.
+//
+// Server serves the engine over the Docker Engine API, to exercise the Docker
+// client itself, and Local runs the commands as processes of the host. Record
+// and Replay save the interactions with a Docker engine to a Cassette and play
+// them back without the engine.
+package dexectest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	dexec "github.com/silentred/go-dexec"
+)
+
+var _ dexec.Client = (*Client)(nil)
+
+// Program is the behavior of a command run by the engine. It returns the exit
+// code of the command.
+type Program func(p *Process) int
+
+// Script returns a Program that writes stdout and stderr and exits with the
+// exit code, ignoring its arguments and standard input.
+func Script(stdout, stderr string, exitCode int) Program {
+	return func(p *Process) int {
+		io.WriteString(p.Stdout, stdout)
+		io.WriteString(p.Stderr, stderr)
+		return exitCode
+	}
+}
+
+// Idle is a Program that runs until it receives a signal, like
+// "tail -f /dev/null", the command of the containers of a dexec.Pool.
+func Idle(p *Process) int {
+	select {
+	case sig := <-p.Signals:
+		return ExitCode(sig)
+	case <-p.Killed:
+		return ExitCode("SIGKILL")
+	}
+}
+
+// NotFound is the Program run for the commands without a registered Program.
+// It exits with 127 like a shell.
+func NotFound(p *Process) int {
+	fmt.Fprintf(p.Stderr, "exec: %q: executable file not found in $PATH\n", p.Args[0])
+	return 127
+}
+
+// Client is an in-memory Docker engine. Its zero value is not usable, use
+// NewClient.
+type Client struct {
+	mu         sync.Mutex
+	programs   map[string]Program
+	fallback   Program
+	images     map[string]*image // by reference and ID
+	containers map[string]*container
+	execs      map[string]*execInstance
+	pid        int // of the last started process
+}
+
+// NewClient returns an engine without images nor registered programs.
+func NewClient() *Client {
+	return &Client{
+		programs:   make(map[string]Program),
+		fallback:   NotFound,
+		images:     make(map[string]*image),
+		containers: make(map[string]*container),
+		execs:      make(map[string]*execInstance),
+	}
+}
+
+// Handle registers the Program run for the commands named name, that is the
+// first element of the entrypoint and command of a container or of the
+// command of an exec instance.
+func (c *Client) Handle(name string, p Program) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.programs[name] = p
+}
+
+// HandleDefault registers the Program run for the commands without a
+// registered Program, instead of NotFound.
+func (c *Client) HandleDefault(p Program) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fallback = p
+}
+
+// AddImage adds an empty image with the reference, as if it was pulled.
+func (c *Client) AddImage(ref string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.addImageLocked(ref, newImage(nil))
+}
+
+// Containers returns the IDs of the containers of the engine, which is handy
+// to check that none is left behind.
+func (c *Client) Containers() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return sortedKeys(c.containers)
+}
+
+func (c *Client) programLocked(name string) Program {
+	if p, ok := c.programs[name]; ok {
+		return p
+	}
+	return c.fallback
+}
+
+// Process is a command run by the engine, passed to its Program.
+type Process struct {
+	// Args is the command with its arguments.
+	Args []string
+
+	// Env and Dir are the environment variables and the working directory of
+	// the command.
+	Env []string
+	Dir string
+
+	// Tty reports whether the command has a pseudo-terminal, in which case
+	// Stdout and Stderr write to the same stream.
+	Tty bool
+
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Signals receives the signals sent to the command other than SIGKILL,
+	// such as "SIGTERM".
+	Signals <-chan string
+
+	// Killed is closed when the command is killed with SIGKILL or its
+	// container is removed. The command has then already exited with 137,
+	// the Program should return as soon as possible.
+	Killed <-chan struct{}
+
+	c    *Client
+	ctr  *container
+	proc *process
+}
+
+// ReadFile returns the content of a file of the container.
+func (p *Process) ReadFile(name string) ([]byte, error) {
+	return p.ctr.fs.readFile(name)
+}
+
+// WriteFile creates or replaces a file of the container.
+func (p *Process) WriteFile(name string, data []byte) error {
+	return p.ctr.fs.writeFile(name, data, 0644)
+}
+
+// RemoveFile removes a file of the container.
+func (p *Process) RemoveFile(name string) error {
+	return p.ctr.fs.remove(name)
+}
+
+// Proc describes a process running in a container, as listed by
+// Process.Procs.
+type Proc struct {
+	Pid  int
+	Args []string
+	Env  []string
+
+	// Exec reports whether the process was started by an exec instance
+	// rather than as the command of the container.
+	Exec bool
+}
+
+// Procs returns the processes running in the container of the command,
+// including itself, ordered by pid.
+func (p *Process) Procs() []Proc {
+	p.c.mu.Lock()
+	defer p.c.mu.Unlock()
+	var procs []Proc
+	for _, proc := range p.procsLocked() {
+		procs = append(procs, Proc{Pid: proc.pid, Args: proc.args, Env: proc.env, Exec: proc != p.ctr.proc})
+	}
+	sort.Slice(procs, func(i, j int) bool { return procs[i].Pid < procs[j].Pid })
+	return procs
+}
+
+// Kill sends the signal, such as "TERM" or "SIGTERM", to the process of the
+// container with the pid, like kill(1) run in the container.
+func (p *Process) Kill(pid int, sig string) error {
+	name, err := parseSignal(sig)
+	if err != nil {
+		return err
+	}
+	p.c.mu.Lock()
+	defer p.c.mu.Unlock()
+	for _, proc := range p.procsLocked() {
+		if proc.pid == pid {
+			p.c.signalLocked(proc, name)
+			return nil
+		}
+	}
+	return fmt.Errorf("kill %d: No such process", pid)
+}
+
+// procsLocked returns the running processes of the container of the command.
+func (p *Process) procsLocked() []*process {
+	var procs []*process
+	if proc := p.ctr.proc; proc != nil && !proc.exited {
+		procs = append(procs, proc)
+	}
+	for _, e := range p.c.execs {
+		if e.ctr == p.ctr && e.proc != nil && !e.proc.exited {
+			procs = append(procs, e.proc)
+		}
+	}
+	return procs
+}
+
+// Size returns the size of the terminal of the command, as last set by
+// ContainerResize or ContainerExecResize.
+func (p *Process) Size() (rows, cols uint) {
+	p.proc.mu.Lock()
+	defer p.proc.mu.Unlock()
+	return p.proc.rows, p.proc.cols
+}
+
+// notFoundError is recognized by client.IsErrNotFound.
+type notFoundError struct{ msg string }
+
+func (e notFoundError) Error() string  { return e.msg }
+func (e notFoundError) NotFound() bool { return true }
+
+// invalidParameterError is the error of a request with invalid parameters.
+type invalidParameterError struct{ msg string }
+
+func (e invalidParameterError) Error() string          { return e.msg }
+func (e invalidParameterError) InvalidParameter() bool { return true }
+
+// conflictError is the error of a request conflicting with the state of the
+// engine, such as removing a running container without force.
+type conflictError struct{ msg string }
+
+func (e conflictError) Error() string  { return e.msg }
+func (e conflictError) Conflict() bool { return true }
+
+func newID() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withDefaultTag adds the "latest" tag to an image reference without a tag
+// or a digest.
+func withDefaultTag(ref string) string {
+	if strings.Contains(ref, "@") || strings.Contains(ref[strings.LastIndex(ref, "/")+1:], ":") {
+		return ref
+	}
+	return ref + ":latest"
+}
@@ -0,0 +1,187 @@
+package dexectest
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	types "github.com/docker/docker/api/types"
+	containertypes "github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	. "gopkg.in/check.v1"
+)
+
+// Hook up gocheck into the "go test" runner.
+func Test(t *testing.T) { TestingT(t) }
+
+var _ = Suite(&ClientTestSuite{})
+
+type ClientTestSuite struct {
+	cl  *Client
+	ctx context.Context
+}
+
+func (s *ClientTestSuite) SetUpTest(c *C) {
+	s.cl = NewClient()
+	s.cl.AddImage("busybox")
+	s.cl.Handle("tail", Idle)
+	s.ctx = context.Background()
+}
+
+func (s *ClientTestSuite) create(c *C, config *containertypes.Config) string {
+	if config.Image == "" {
+		config.Image = "busybox"
+	}
+	resp, err := s.cl.ContainerCreate(s.ctx, config, nil, nil, "")
+	c.Assert(err, IsNil)
+	return resp.ID
+}
+
+func (s *ClientTestSuite) wait(c *C, id string) int64 {
+	resultC, errC := s.cl.ContainerWait(s.ctx, id, containertypes.WaitConditionNextExit)
+	select {
+	case err := <-errC:
+		c.Fatal(err)
+	case result := <-resultC:
+		return result.StatusCode
+	}
+	return 0
+}
+
+func (s *ClientTestSuite) TestParseSignal(c *C) {
+	for in, want := range map[string]string{"": "SIGKILL", "term": "SIGTERM", "SIGHUP": "SIGHUP", "9": "SIGKILL"} {
+		sig, err := parseSignal(in)
+		c.Assert(err, IsNil)
+		c.Assert(sig, Equals, want)
+	}
+	_, err := parseSignal("SIGFOO")
+	c.Assert(err, ErrorMatches, "Invalid signal: SIGFOO")
+	c.Assert(ExitCode("SIGTERM"), Equals, 143)
+}
+
+func (s *ClientTestSuite) TestWithDefaultTag(c *C) {
+	c.Assert(withDefaultTag("busybox"), Equals, "busybox:latest")
+	c.Assert(withDefaultTag("localhost:5000/busybox"), Equals, "localhost:5000/busybox:latest")
+	c.Assert(withDefaultTag("busybox:1"), Equals, "busybox:1")
+	c.Assert(withDefaultTag("busybox@sha256:abc"), Equals, "busybox@sha256:abc")
+}
+
+func (s *ClientTestSuite) TestRemoveRunning(c *C) {
+	id := s.create(c, &containertypes.Config{Entrypoint: []string{"tail"}})
+	c.Assert(s.cl.ContainerStart(s.ctx, id, types.ContainerStartOptions{}), IsNil)
+
+	err := s.cl.ContainerRemove(s.ctx, id, types.ContainerRemoveOptions{})
+	c.Assert(err, ErrorMatches, "You cannot remove a running container .*")
+	c.Assert(s.cl.ContainerRemove(s.ctx, id, types.ContainerRemoveOptions{Force: true}), IsNil)
+
+	_, err = s.cl.ContainerInspect(s.ctx, id)
+	c.Assert(err, ErrorMatches, "No such container: .*")
+	c.Assert(err.(interface{ NotFound() bool }).NotFound(), Equals, true)
+}
+
+func (s *ClientTestSuite) TestStopTimeout(c *C) {
+	s.cl.Handle("stubborn", func(p *Process) int {
+		<-p.Killed
+		return 0
+	})
+	id := s.create(c, &containertypes.Config{Entrypoint: []string{"stubborn"}})
+	c.Assert(s.cl.ContainerStart(s.ctx, id, types.ContainerStartOptions{}), IsNil)
+	timeout := 10 * time.Millisecond
+	c.Assert(s.cl.ContainerStop(s.ctx, id, &timeout), IsNil)
+	c.Assert(s.wait(c, id), Equals, int64(137))
+}
+
+func (s *ClientTestSuite) TestExecKilledWithContainer(c *C) {
+	id := s.create(c, &containertypes.Config{Entrypoint: []string{"tail"}})
+	c.Assert(s.cl.ContainerStart(s.ctx, id, types.ContainerStartOptions{}), IsNil)
+	resp, err := s.cl.ContainerExecCreate(s.ctx, id, types.ExecConfig{Cmd: []string{"tail"}})
+	c.Assert(err, IsNil)
+	hr, err := s.cl.ContainerExecAttach(s.ctx, resp.ID, types.ExecStartCheck{})
+	c.Assert(err, IsNil)
+	defer hr.Close()
+
+	c.Assert(s.cl.ContainerKill(s.ctx, id, "SIGTERM"), IsNil)
+	c.Assert(s.wait(c, id), Equals, int64(143))
+	info, err := s.cl.ContainerExecInspect(s.ctx, resp.ID)
+	c.Assert(err, IsNil)
+	c.Assert(info.Running, Equals, false)
+	c.Assert(info.ExitCode, Equals, 137)
+}
+
+func (s *ClientTestSuite) TestListLabels(c *C) {
+	a := s.create(c, &containertypes.Config{Entrypoint: []string{"tail"}, Labels: map[string]string{"job": "a"}})
+	s.create(c, &containertypes.Config{Entrypoint: []string{"tail"}, Labels: map[string]string{"job": "b"}})
+	s.create(c, &containertypes.Config{Entrypoint: []string{"tail"}})
+
+	list, err := s.cl.ContainerList(s.ctx, types.ContainerListOptions{All: true, Filters: filters.NewArgs(filters.Arg("label", "job"))})
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 2)
+
+	list, err = s.cl.ContainerList(s.ctx, types.ContainerListOptions{All: true, Filters: filters.NewArgs(filters.Arg("label", "job=a"))})
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 1)
+	c.Assert(list[0].ID, Equals, a)
+	c.Assert(list[0].State, Equals, "created")
+
+	list, err = s.cl.ContainerList(s.ctx, types.ContainerListOptions{})
+	c.Assert(err, IsNil)
+	c.Assert(list, HasLen, 0) // none is running
+}
+
+func (s *ClientTestSuite) TestDiff(c *C) {
+	img := newImage(nil)
+	img.fs.writeFile("/etc/passwd", []byte("root"), 0644)
+	img.fs.writeFile("/etc/group", []byte("root"), 0644)
+	img.fs.writeFile("/var/log/old", nil, 0644)
+	s.cl.mu.Lock()
+	s.cl.addImageLocked("base", img)
+	s.cl.mu.Unlock()
+
+	s.cl.Handle("change", func(p *Process) int {
+		p.WriteFile("/etc/passwd", []byte("root\nuser"))
+		p.WriteFile("/tmp/new/file", nil)
+		p.RemoveFile("/var/log")
+		return 0
+	})
+	id := s.create(c, &containertypes.Config{Image: "base", Entrypoint: []string{"change"}})
+	c.Assert(s.cl.ContainerStart(s.ctx, id, types.ContainerStartOptions{}), IsNil)
+	c.Assert(s.wait(c, id), Equals, int64(0))
+
+	changes, err := s.cl.ContainerDiff(s.ctx, id)
+	c.Assert(err, IsNil)
+	c.Assert(changes, DeepEquals, []containertypes.ContainerChangeResponseItem{
+		{Kind: changeModify, Path: "/etc"},
+		{Kind: changeModify, Path: "/etc/passwd"},
+		{Kind: changeAdd, Path: "/tmp"},
+		{Kind: changeAdd, Path: "/tmp/new"},
+		{Kind: changeAdd, Path: "/tmp/new/file"},
+		{Kind: changeModify, Path: "/var"},
+		{Kind: changeDelete, Path: "/var/log"},
+	})
+}
+
+func (s *ClientTestSuite) TestCopyFromContainer(c *C) {
+	id := s.create(c, &containertypes.Config{Entrypoint: []string{"tail"}})
+	s.cl.containers[id].fs.writeFile("/out/a/b", []byte("b"), 0600)
+
+	rc, stat, err := s.cl.CopyFromContainer(s.ctx, id, "/out/")
+	c.Assert(err, IsNil)
+	c.Assert(stat.Name, Equals, "out")
+	c.Assert(stat.Mode.IsDir(), Equals, true)
+	var names []string
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		c.Assert(err, IsNil)
+		names = append(names, hdr.Name)
+	}
+	c.Assert(names, DeepEquals, []string{"out/", "out/a/", "out/a/b"})
+
+	_, _, err = s.cl.CopyFromContainer(s.ctx, id, "/missing")
+	c.Assert(err, ErrorMatches, "Could not find the file /missing in container .*")
+}
@@ -0,0 +1,118 @@
+package dexectest
+
+import (
+	"context"
+	"fmt"
+
+	types "github.com/docker/docker/api/types"
+)
+
+type execInstance struct {
+	id      string
+	ctr     *container
+	config  types.ExecConfig
+	proc    *process
+	running bool
+	code    int
+}
+
+func (c *Client) execLocked(id string) (*execInstance, error) {
+	e, ok := c.execs[id]
+	if !ok {
+		return nil, notFoundError{"No such exec instance: " + id}
+	}
+	return e, nil
+}
+
+func (c *Client) ContainerExecCreate(ctx context.Context, container string, config types.ExecConfig) (types.IDResponse, error) {
+	if len(config.Cmd) == 0 {
+		return types.IDResponse{}, invalidParameterError{"No exec command specified"}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ctr, err := c.containerLocked(container)
+	if err != nil {
+		return types.IDResponse{}, err
+	}
+	if ctr.state != stateRunning {
+		return types.IDResponse{}, conflictError{fmt.Sprintf("Container %s is not running", ctr.id)}
+	}
+	e := &execInstance{id: newID(), ctr: ctr, config: config}
+	e.config.Cmd = append([]string(nil), config.Cmd...)
+	c.execs[e.id] = e
+	return types.IDResponse{ID: e.id}, nil
+}
+
+// ContainerExecAttach starts the exec instance and returns a connection to its
+// standard streams.
+func (c *Client) ContainerExecAttach(ctx context.Context, execID string, config types.ExecStartCheck) (types.HijackedResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, err := c.execLocked(execID)
+	if err != nil {
+		return types.HijackedResponse{}, err
+	}
+	if e.proc != nil {
+		return types.HijackedResponse{}, conflictError{fmt.Sprintf("Error: Exec command %s has already run", e.id)}
+	}
+	if e.ctr.state != stateRunning {
+		return types.HijackedResponse{}, conflictError{fmt.Sprintf("Container %s is not running", e.ctr.id)}
+	}
+
+	dir := e.config.WorkingDir
+	if dir == "" {
+		dir = e.ctr.config.WorkingDir
+	}
+	if dir == "" {
+		dir = "/"
+	}
+	conn := newHijackConn()
+	e.running = true
+	e.proc = c.startLocked(e.ctr, procSpec{
+		args:   e.config.Cmd,
+		env:    append(append([]string(nil), e.ctr.config.Env...), e.config.Env...),
+		dir:    dir,
+		tty:    e.config.Tty,
+		conn:   conn,
+		stdin:  e.config.AttachStdin,
+		stdout: e.config.AttachStdout,
+		stderr: e.config.AttachStderr,
+	}, func(code int) {
+		e.running = false
+		e.code = code
+	})
+	return conn.response(), nil
+}
+
+func (c *Client) ContainerExecInspect(ctx context.Context, execID string) (types.ContainerExecInspect, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, err := c.execLocked(execID)
+	if err != nil {
+		return types.ContainerExecInspect{}, err
+	}
+	resp := types.ContainerExecInspect{
+		ExecID:      e.id,
+		ContainerID: e.ctr.id,
+		Running:     e.running,
+		ExitCode:    e.code,
+	}
+	if e.running {
+		resp.Pid = e.proc.pid
+	}
+	return resp, nil
+}
+
+func (c *Client) ContainerExecResize(ctx context.Context, execID string, options types.ResizeOptions) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, err := c.execLocked(execID)
+	if err != nil {
+		return err
+	}
+	if !e.running {
+		return conflictError{fmt.Sprintf("Exec %s is not running", e.id)}
+	}
+	e.proc.resize(options.Height, options.Width)
+	return nil
+}
@@ -0,0 +1,275 @@
+package dexectest
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	containertypes "github.com/docker/docker/api/types/container"
+)
+
+// Kinds of ContainerChangeResponseItem, as reported by the Docker API.
+const (
+	changeModify uint8 = iota
+	changeAdd
+	changeDelete
+)
+
+// node is a file, directory or symbolic link. Nodes are never modified but
+// replaced, so that a filesystem can share them with the one it was copied
+// from and tell the changes by identity.
+type node struct {
+	mode  fs.FileMode
+	data  []byte // content of a file, or target of a symbolic link
+	mtime time.Time
+}
+
+// memFS is the filesystem of a container or an image.
+type memFS struct {
+	mu    sync.Mutex
+	nodes map[string]*node // by clean absolute path
+}
+
+// newMemFS returns a copy of from, or a filesystem with only the root
+// directory if from is nil.
+func newMemFS(from *memFS) *memFS {
+	m := &memFS{nodes: make(map[string]*node)}
+	if from == nil {
+		m.nodes["/"] = &node{mode: fs.ModeDir | 0755, mtime: time.Now()}
+		return m
+	}
+	from.mu.Lock()
+	defer from.mu.Unlock()
+	for p, n := range from.nodes {
+		m.nodes[p] = n
+	}
+	return m
+}
+
+func cleanPath(name string) string { return path.Clean("/" + name) }
+
+func (m *memFS) readFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n, ok := m.nodes[cleanPath(name)]
+	switch {
+	case !ok:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	case !n.mode.IsRegular():
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("not a regular file")}
+	}
+	return append([]byte(nil), n.data...), nil
+}
+
+func (m *memFS) writeFile(name string, data []byte, perm fs.FileMode) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.putLocked(cleanPath(name), &node{mode: perm.Perm(), data: append([]byte(nil), data...), mtime: time.Now()})
+}
+
+func (m *memFS) remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p := cleanPath(name)
+	if _, ok := m.nodes[p]; !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if p == "/" {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+	}
+	for q := range m.nodes {
+		if q == p || strings.HasPrefix(q, p+"/") {
+			delete(m.nodes, q)
+		}
+	}
+	return nil
+}
+
+// putLocked sets the node at the clean path p, creating its missing parent
+// directories.
+func (m *memFS) putLocked(p string, n *node) error {
+	if err := m.mkdirAllLocked(path.Dir(p)); err != nil {
+		return err
+	}
+	if old, ok := m.nodes[p]; ok && old.mode.IsDir() {
+		if n.mode.IsDir() {
+			return nil
+		}
+		return &fs.PathError{Op: "open", Path: p, Err: errors.New("is a directory")}
+	}
+	m.nodes[p] = n
+	return nil
+}
+
+func (m *memFS) mkdirAllLocked(p string) error {
+	if n, ok := m.nodes[p]; ok {
+		if !n.mode.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: p, Err: errors.New("not a directory")}
+		}
+		return nil
+	}
+	if err := m.mkdirAllLocked(path.Dir(p)); err != nil {
+		return err
+	}
+	m.nodes[p] = &node{mode: fs.ModeDir | 0755, mtime: time.Now()}
+	return nil
+}
+
+// extract extracts the tar archive into the directory dst.
+func (m *memFS) extract(dst string, r io.Reader) error {
+	dst = cleanPath(dst)
+	m.mu.Lock()
+	n, ok := m.nodes[dst]
+	m.mu.Unlock()
+	if !ok || !n.mode.IsDir() {
+		return notFoundError{fmt.Sprintf("No such directory: %s", dst)}
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		p := path.Join(dst, cleanPath(hdr.Name))
+		n := &node{mode: fs.FileMode(hdr.Mode).Perm(), mtime: hdr.ModTime}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			n.mode |= fs.ModeDir
+		case tar.TypeSymlink:
+			n.mode |= fs.ModeSymlink
+			n.data = []byte(hdr.Linkname)
+		case tar.TypeReg, tar.TypeRegA:
+			if n.data, err = io.ReadAll(tr); err != nil {
+				return err
+			}
+		default:
+			continue
+		}
+		m.mu.Lock()
+		err = m.putLocked(p, n)
+		m.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// archive returns a tar archive of the file or directory src, with the names
+// of the entries starting with the base name of src.
+func (m *memFS) archive(src string) ([]byte, *node, error) {
+	src = cleanPath(src)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	root, ok := m.nodes[src]
+	if !ok {
+		return nil, nil, &fs.PathError{Op: "stat", Path: src, Err: fs.ErrNotExist}
+	}
+
+	var paths []string
+	for p := range m.nodes {
+		if p == src || strings.HasPrefix(p, src+"/") || (src == "/" && p != "/") {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	for _, p := range paths {
+		n := m.nodes[p]
+		hdr := &tar.Header{Mode: int64(n.mode.Perm()), ModTime: n.mtime}
+		if src == "/" {
+			hdr.Name = strings.TrimPrefix(p, "/")
+		} else {
+			hdr.Name = path.Join(path.Base(src), strings.TrimPrefix(p, src))
+		}
+		switch {
+		case n.mode.IsDir():
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+		case n.mode&fs.ModeSymlink != 0:
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = string(n.data)
+		default:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(len(n.data))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, nil, err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := tw.Write(n.data); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, nil, err
+	}
+	return b.Bytes(), root, nil
+}
+
+// diff returns the changes from base the way the Docker API reports them:
+// added and deleted paths, and modified files and directories, including
+// the directories whose contents changed.
+func (m *memFS) diff(base *memFS) []containertypes.ContainerChangeResponseItem {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	base.mu.Lock()
+	defer base.mu.Unlock()
+
+	changes := make(map[string]uint8)
+	changed := func(p string, kind uint8) {
+		changes[p] = kind
+		for dir := path.Dir(p); dir != "/"; dir = path.Dir(dir) {
+			if _, ok := changes[dir]; ok {
+				continue
+			}
+			if _, ok := base.nodes[dir]; ok {
+				changes[dir] = changeModify
+			}
+		}
+	}
+	for p, n := range m.nodes {
+		if old, ok := base.nodes[p]; !ok {
+			changed(p, changeAdd)
+		} else if old != n {
+			changed(p, changeModify)
+		}
+	}
+	for p := range base.nodes {
+		if _, ok := m.nodes[p]; ok {
+			continue
+		}
+		// only the topmost deleted path is reported
+		if _, ok := m.nodes[path.Dir(p)]; ok {
+			changed(p, changeDelete)
+		}
+	}
+
+	items := make([]containertypes.ContainerChangeResponseItem, 0, len(changes))
+	for _, p := range sortedKeys(changes) {
+		items = append(items, containertypes.ContainerChangeResponseItem{Kind: changes[p], Path: p})
+	}
+	return items
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
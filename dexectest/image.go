@@ -0,0 +1,119 @@
+package dexectest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	types "github.com/docker/docker/api/types"
+	containertypes "github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+type image struct {
+	id     string
+	tags   []string
+	fs     *memFS
+	labels map[string]string
+}
+
+// newImage returns an untagged image with the filesystem, or an empty one if
+// fs is nil.
+func newImage(fs *memFS) *image {
+	if fs == nil {
+		fs = newMemFS(nil)
+	}
+	return &image{id: "sha256:" + newID(), fs: fs}
+}
+
+// addImageLocked tags the image with ref, removing the tag from the image it
+// referred to.
+func (c *Client) addImageLocked(ref string, img *image) {
+	tag := withDefaultTag(ref)
+	if old, ok := c.images[tag]; ok {
+		for i, t := range old.tags {
+			if t == tag {
+				old.tags = append(old.tags[:i:i], old.tags[i+1:]...)
+				break
+			}
+		}
+	}
+	img.tags = append(img.tags, tag)
+	c.images[tag] = img
+	c.images[img.id] = img
+}
+
+// imageLocked returns the image with the reference or ID.
+func (c *Client) imageLocked(ref string) (*image, error) {
+	for _, key := range []string{ref, "sha256:" + ref, withDefaultTag(ref)} {
+		if img, ok := c.images[key]; ok {
+			return img, nil
+		}
+	}
+	return nil, notFoundError{"No such image: " + ref}
+}
+
+// ImagePull adds an empty image with the reference if it does not exist.
+func (c *Client) ImagePull(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	status := "Image is up to date for " + ref
+	if _, err := c.imageLocked(ref); err != nil {
+		c.addImageLocked(ref, newImage(nil))
+		status = "Downloaded newer image for " + ref
+	}
+	tagged := withDefaultTag(ref)
+	i := strings.LastIndex(tagged, ":")
+	return jsonStream(
+		jsonmessage.JSONMessage{Status: "Pulling from " + tagged[:i], ID: tagged[i+1:]},
+		jsonmessage.JSONMessage{Status: "Status: " + status},
+	), nil
+}
+
+func (c *Client) ImageInspectWithRaw(ctx context.Context, image string) (types.ImageInspect, []byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	img, err := c.imageLocked(image)
+	if err != nil {
+		return types.ImageInspect{}, nil, err
+	}
+	inspect := types.ImageInspect{
+		ID:       img.id,
+		RepoTags: append([]string(nil), img.tags...),
+		Config:   &containertypes.Config{Labels: copyLabels(img.labels)},
+	}
+	raw, err := json.Marshal(inspect)
+	return inspect, raw, err
+}
+
+// ImageBuild reads the build context and tags an empty image, the Dockerfile
+// is not run.
+func (c *Client) ImageBuild(ctx context.Context, buildContext io.Reader, options types.ImageBuildOptions) (types.ImageBuildResponse, error) {
+	if _, err := io.Copy(io.Discard, buildContext); err != nil {
+		return types.ImageBuildResponse{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	img := newImage(nil)
+	c.images[img.id] = img
+	msgs := []jsonmessage.JSONMessage{{Stream: fmt.Sprintf("Successfully built %s\n", img.id[len("sha256:"):][:12])}}
+	for _, tag := range options.Tags {
+		c.addImageLocked(tag, img)
+		msgs = append(msgs, jsonmessage.JSONMessage{Stream: fmt.Sprintf("Successfully tagged %s\n", withDefaultTag(tag))})
+	}
+	return types.ImageBuildResponse{Body: jsonStream(msgs...), OSType: "linux"}, nil
+}
+
+// jsonStream returns the messages encoded the way the Docker API streams
+// them.
+func jsonStream(msgs ...jsonmessage.JSONMessage) io.ReadCloser {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	for _, msg := range msgs {
+		enc.Encode(msg)
+	}
+	return io.NopCloser(&b)
+}
@@ -0,0 +1,62 @@
+package dexectest
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// Local is a Program that runs the command as a process of the host, with the
+// environment of the host and of the command, and forwards the signals it
+// receives. The process runs in the current directory and does not see the
+// files of the container.
+//
+// Register it with HandleDefault to run all the commands on the host.
+func Local(p *Process) int {
+	cmd := exec.Command(p.Args[0], p.Args[1:]...)
+	cmd.Env = append(os.Environ(), p.Env...)
+	cmd.Stdout, cmd.Stderr = p.Stdout, p.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		fmt.Fprintln(p.Stderr, err)
+		return 126
+	}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintln(p.Stderr, err)
+		if errors.Is(err, exec.ErrNotFound) || errors.Is(err, os.ErrNotExist) {
+			return 127
+		}
+		return 126
+	}
+	// not waited for, as the standard input may outlive the process
+	go func() {
+		io.Copy(stdin, p.Stdin)
+		stdin.Close()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case sig := <-p.Signals:
+				cmd.Process.Signal(syscall.Signal(signals[strings.TrimPrefix(sig, "SIG")]))
+			case <-p.Killed:
+				cmd.Process.Kill()
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+	cmd.Wait()
+	close(done)
+
+	if ws, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal())
+	}
+	return cmd.ProcessState.ExitCode()
+}
@@ -0,0 +1,222 @@
+package dexectest
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	types "github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// signals maps the names of the signals the engine accepts, without the
+// "SIG" prefix, to their numbers.
+var signals = map[string]int{
+	"HUP":   1,
+	"INT":   2,
+	"QUIT":  3,
+	"KILL":  9,
+	"USR1":  10,
+	"USR2":  12,
+	"TERM":  15,
+	"WINCH": 28,
+}
+
+// parseSignal returns the name of the signal given by name or number, in the
+// form "SIGTERM". An empty signal is SIGKILL.
+func parseSignal(sig string) (string, error) {
+	if sig == "" {
+		return "SIGKILL", nil
+	}
+	name := strings.TrimPrefix(strings.ToUpper(sig), "SIG")
+	if n, err := strconv.Atoi(name); err == nil {
+		for s, num := range signals {
+			if num == n {
+				return "SIG" + s, nil
+			}
+		}
+	} else if _, ok := signals[name]; ok {
+		return "SIG" + name, nil
+	}
+	return "", invalidParameterError{"Invalid signal: " + sig}
+}
+
+// ExitCode returns the exit code of a command terminated by the signal, such
+// as 143 for "SIGTERM", or 128 if the signal is unknown.
+func ExitCode(signal string) int {
+	return 128 + signals[strings.TrimPrefix(signal, "SIG")]
+}
+
+// procSpec describes a process to start.
+type procSpec struct {
+	args []string
+	env  []string
+	dir  string
+	tty  bool
+
+	// conn is the attached connection, if any, and stdin, stdout and stderr
+	// are the streams attached to it.
+	conn                  *hijackConn
+	stdin, stdout, stderr bool
+}
+
+// process is a running Program. Its fields are guarded by the lock of the
+// Client, except for the size of the terminal.
+type process struct {
+	pid     int
+	args    []string
+	env     []string
+	signals chan string
+	killed  chan struct{}
+	conn    *hijackConn
+	exited  bool
+	code    int
+	onExit  func(code int) // called with the lock of the Client held
+
+	mu         sync.Mutex
+	rows, cols uint
+}
+
+// startLocked runs the Program of the command of spec in ctr.
+func (c *Client) startLocked(ctr *container, spec procSpec, onExit func(code int)) *process {
+	c.pid++
+	p := &process{
+		pid:     c.pid,
+		args:    spec.args,
+		env:     spec.env,
+		signals: make(chan string, 16),
+		killed:  make(chan struct{}),
+		conn:    spec.conn,
+		onExit:  onExit,
+	}
+	proc := &Process{
+		Args:    spec.args,
+		Env:     spec.env,
+		Dir:     spec.dir,
+		Tty:     spec.tty,
+		Stdin:   strings.NewReader(""),
+		Stdout:  io.Discard,
+		Stderr:  io.Discard,
+		Signals: p.signals,
+		Killed:  p.killed,
+		c:       c,
+		ctr:     ctr,
+		proc:    p,
+	}
+	if conn := spec.conn; conn != nil {
+		if spec.stdin {
+			proc.Stdin = conn.stdinR
+		}
+		stdout, stderr := io.Writer(conn.outW), io.Writer(conn.outW)
+		if !spec.tty {
+			stdout = stdcopy.NewStdWriter(conn.outW, stdcopy.Stdout)
+			stderr = stdcopy.NewStdWriter(conn.outW, stdcopy.Stderr)
+		}
+		if spec.stdout {
+			proc.Stdout = stdout
+		}
+		if spec.stderr {
+			proc.Stderr = stderr
+		}
+	}
+
+	program := c.programLocked(spec.args[0])
+	go func() {
+		code := program(proc)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.exitLocked(p, code)
+	}()
+	return p
+}
+
+// exitLocked records the exit of the process, unless it already exited.
+func (c *Client) exitLocked(p *process, code int) {
+	if p.exited {
+		return
+	}
+	p.exited = true
+	p.code = code
+	if p.conn != nil {
+		p.conn.hangUp()
+	}
+	p.onExit(code)
+}
+
+// signalLocked sends the signal, as returned by parseSignal, to the process.
+// The signals other than SIGKILL are dropped if the Program does not receive
+// them.
+func (c *Client) signalLocked(p *process, sig string) {
+	if p.exited {
+		return
+	}
+	if sig == "SIGKILL" {
+		close(p.killed)
+		c.exitLocked(p, ExitCode(sig))
+		return
+	}
+	select {
+	case p.signals <- sig:
+	default:
+	}
+}
+
+func (p *process) resize(rows, cols uint) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.rows, p.cols = rows, cols
+}
+
+// hijackConn is the client end of an attached connection: writes go to the
+// standard input of the process and reads return its output. Deadlines are
+// not supported and ignored.
+type hijackConn struct {
+	stdinR *io.PipeReader
+	stdinW *io.PipeWriter
+	outR   *io.PipeReader
+	outW   *io.PipeWriter
+}
+
+func newHijackConn() *hijackConn {
+	c := new(hijackConn)
+	c.stdinR, c.stdinW = io.Pipe()
+	c.outR, c.outW = io.Pipe()
+	return c
+}
+
+func (c *hijackConn) response() types.HijackedResponse {
+	return types.HijackedResponse{Conn: c, Reader: bufio.NewReader(c)}
+}
+
+func (c *hijackConn) Read(b []byte) (int, error)  { return c.outR.Read(b) }
+func (c *hijackConn) Write(b []byte) (int, error) { return c.stdinW.Write(b) }
+func (c *hijackConn) CloseWrite() error           { return c.stdinW.Close() }
+
+func (c *hijackConn) Close() error {
+	c.stdinW.Close()
+	c.outR.Close()
+	return nil
+}
+
+// hangUp ends the output once the process exited. Writes to the standard
+// input then fail with EPIPE, as they would on a socket closed by the engine.
+func (c *hijackConn) hangUp() {
+	c.stdinR.CloseWithError(syscall.EPIPE)
+	c.outW.Close()
+}
+
+func (c *hijackConn) LocalAddr() net.Addr                { return pipeAddr{} }
+func (c *hijackConn) RemoteAddr() net.Addr               { return pipeAddr{} }
+func (c *hijackConn) SetDeadline(t time.Time) error      { return nil }
+func (c *hijackConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *hijackConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "dexectest" }
@@ -0,0 +1,465 @@
+package dexectest
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	types "github.com/docker/docker/api/types"
+	containertypes "github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	networktypes "github.com/docker/docker/api/types/network"
+	docker "github.com/docker/docker/client"
+)
+
+// APIVersion is the version of the Docker Engine API the Server reports and
+// the clients of DockerClient use.
+const APIVersion = "1.37"
+
+// Server serves the endpoints of the Docker Engine API used by dexec with an
+// in-memory engine, so that the Docker client can be tested end to end,
+// including the hijacked connections of attach requests:
+//
+//	srv := dexectest.NewServer(dexectest.NewClient())
+//	defer srv.Close()
+//	cl, err := srv.DockerClient()
+//	d := dexec.Docker{Client: cl}
+type Server struct {
+	*httptest.Server
+
+	// Engine runs the requests, it is nil for the servers of Record and
+	// Replay.
+	Engine *Client
+
+	replayer *replayer // for Replay
+}
+
+// NewServer starts a Server running the requests with engine.
+func NewServer(engine *Client) *Server {
+	s := &Server{Engine: engine}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Host returns the address of the server in the form of DOCKER_HOST.
+func (s *Server) Host() string {
+	return "tcp://" + s.Listener.Addr().String()
+}
+
+// DockerClient returns a Docker client connected to the server.
+func (s *Server) DockerClient() (*docker.Client, error) {
+	return docker.NewClient(s.Host(), APIVersion, nil, nil)
+}
+
+var versionPrefix = regexp.MustCompile(`^/v[0-9.]+`)
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	p := versionPrefix.ReplaceAllString(r.URL.Path, "")
+	route := r.Method + " " + p
+	var err error
+	switch {
+	case route == "GET /_ping" || route == "HEAD /_ping":
+		w.Header().Set("API-Version", APIVersion)
+		io.WriteString(w, "OK")
+	case route == "GET /version":
+		writeJSON(w, http.StatusOK, map[string]string{"Version": "dexectest", "ApiVersion": APIVersion})
+	case route == "POST /containers/create":
+		err = s.createContainer(w, r)
+	case route == "GET /containers/json":
+		err = s.listContainers(w, r)
+	case strings.HasPrefix(p, "/containers/"):
+		id, action, _ := strings.Cut(strings.TrimPrefix(p, "/containers/"), "/")
+		err = s.serveContainer(w, r, id, action)
+	case strings.HasPrefix(p, "/exec/"):
+		id, action, _ := strings.Cut(strings.TrimPrefix(p, "/exec/"), "/")
+		err = s.serveExec(w, r, id, action)
+	case route == "POST /commit":
+		err = s.commit(w, r)
+	case route == "POST /images/create":
+		err = s.pullImage(w, r)
+	case r.Method == http.MethodGet && strings.HasPrefix(p, "/images/") && strings.HasSuffix(p, "/json"):
+		err = s.inspectImage(w, r, strings.TrimSuffix(strings.TrimPrefix(p, "/images/"), "/json"))
+	case route == "POST /build":
+		err = s.build(w, r)
+	default:
+		err = notFoundError{"page not found"}
+	}
+	if err != nil {
+		writeError(w, err)
+	}
+}
+
+func (s *Server) serveContainer(w http.ResponseWriter, r *http.Request, id, action string) error {
+	ctx, q := r.Context(), r.URL.Query()
+	switch r.Method + " " + action {
+	case "POST start":
+		if err := s.Engine.ContainerStart(ctx, id, types.ContainerStartOptions{}); err != nil {
+			return err
+		}
+	case "POST attach":
+		info, err := s.Engine.ContainerInspect(ctx, id)
+		if err != nil {
+			return err
+		}
+		hr, err := s.Engine.ContainerAttach(ctx, id, types.ContainerAttachOptions{
+			Stream: boolValue(q, "stream"),
+			Stdin:  boolValue(q, "stdin"),
+			Stdout: boolValue(q, "stdout"),
+			Stderr: boolValue(q, "stderr"),
+		})
+		if err != nil {
+			return err
+		}
+		hijack(w, hr, !info.Config.Tty)
+		return nil
+	case "POST wait":
+		return s.wait(w, r, id)
+	case "POST kill":
+		if err := s.Engine.ContainerKill(ctx, id, q.Get("signal")); err != nil {
+			return err
+		}
+	case "POST stop":
+		var timeout *time.Duration
+		if t := q.Get("t"); t != "" {
+			secs, err := strconv.Atoi(t)
+			if err != nil {
+				return invalidParameterError{"invalid value for t: " + t}
+			}
+			d := time.Duration(secs) * time.Second
+			timeout = &d
+		}
+		if err := s.Engine.ContainerStop(ctx, id, timeout); err != nil {
+			return err
+		}
+	case "DELETE ":
+		if err := s.Engine.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: boolValue(q, "force")}); err != nil {
+			return err
+		}
+	case "GET json":
+		info, err := s.Engine.ContainerInspect(ctx, id)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, info)
+		return nil
+	case "POST resize":
+		h, _ := strconv.Atoi(q.Get("h"))
+		wd, _ := strconv.Atoi(q.Get("w"))
+		if err := s.Engine.ContainerResize(ctx, id, types.ResizeOptions{Height: uint(h), Width: uint(wd)}); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusOK)
+		return nil
+	case "GET changes":
+		changes, err := s.Engine.ContainerDiff(ctx, id)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, changes)
+		return nil
+	case "POST exec":
+		var config types.ExecConfig
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			return invalidParameterError{err.Error()}
+		}
+		resp, err := s.Engine.ContainerExecCreate(ctx, id, config)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusCreated, resp)
+		return nil
+	case "PUT archive":
+		if err := s.Engine.CopyToContainer(ctx, id, q.Get("path"), r.Body, types.CopyToContainerOptions{}); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusOK)
+		return nil
+	case "GET archive", "HEAD archive":
+		rc, stat, err := s.Engine.CopyFromContainer(ctx, id, q.Get("path"))
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		b, err := json.Marshal(stat)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("X-Docker-Container-Path-Stat", base64.StdEncoding.EncodeToString(b))
+		w.Header().Set("Content-Type", "application/x-tar")
+		if r.Method == http.MethodGet {
+			io.Copy(w, rc)
+		}
+		return nil
+	default:
+		return notFoundError{"page not found"}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *Server) serveExec(w http.ResponseWriter, r *http.Request, id, action string) error {
+	ctx, q := r.Context(), r.URL.Query()
+	switch r.Method + " " + action {
+	case "POST start":
+		var config types.ExecStartCheck
+		if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+			return invalidParameterError{err.Error()}
+		}
+		hr, err := s.Engine.ContainerExecAttach(ctx, id, config)
+		if err != nil {
+			return err
+		}
+		hijack(w, hr, !config.Tty)
+		return nil
+	case "GET json":
+		info, err := s.Engine.ContainerExecInspect(ctx, id)
+		if err != nil {
+			return err
+		}
+		writeJSON(w, http.StatusOK, info)
+		return nil
+	case "POST resize":
+		h, _ := strconv.Atoi(q.Get("h"))
+		wd, _ := strconv.Atoi(q.Get("w"))
+		if err := s.Engine.ContainerExecResize(ctx, id, types.ResizeOptions{Height: uint(h), Width: uint(wd)}); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	return notFoundError{"page not found"}
+}
+
+func (s *Server) createContainer(w http.ResponseWriter, r *http.Request) error {
+	var body struct {
+		*containertypes.Config
+		HostConfig       *containertypes.HostConfig
+		NetworkingConfig *networktypes.NetworkingConfig
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return invalidParameterError{err.Error()}
+	}
+	resp, err := s.Engine.ContainerCreate(r.Context(), body.Config, body.HostConfig, body.NetworkingConfig, r.URL.Query().Get("name"))
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusCreated, resp)
+	return nil
+}
+
+func (s *Server) listContainers(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	args, err := parseFilters(q.Get("filters"))
+	if err != nil {
+		return err
+	}
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	list, err := s.Engine.ContainerList(r.Context(), types.ContainerListOptions{All: boolValue(q, "all"), Limit: limit, Filters: args})
+	if err != nil {
+		return err
+	}
+	if list == nil {
+		list = []types.Container{}
+	}
+	writeJSON(w, http.StatusOK, list)
+	return nil
+}
+
+// wait responds once the container meets the condition. The headers are sent
+// right away, as the Docker engine does.
+func (s *Server) wait(w http.ResponseWriter, r *http.Request, id string) error {
+	if _, err := s.Engine.ContainerInspect(r.Context(), id); err != nil {
+		return err
+	}
+	resultC, errC := s.Engine.ContainerWait(r.Context(), id, containertypes.WaitCondition(r.URL.Query().Get("condition")))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	select {
+	case result := <-resultC:
+		json.NewEncoder(w).Encode(result)
+	case err := <-errC:
+		json.NewEncoder(w).Encode(containertypes.ContainerWaitOKBody{
+			StatusCode: -1,
+			Error:      &containertypes.ContainerWaitOKBodyError{Message: err.Error()},
+		})
+	}
+	return nil
+}
+
+func (s *Server) commit(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	ref := q.Get("repo")
+	if tag := q.Get("tag"); ref != "" && tag != "" {
+		ref += ":" + tag
+	}
+	var config *containertypes.Config
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil && err != io.EOF {
+		return invalidParameterError{err.Error()}
+	}
+	resp, err := s.Engine.ContainerCommit(r.Context(), q.Get("container"), types.ContainerCommitOptions{
+		Reference: ref,
+		Comment:   q.Get("comment"),
+		Author:    q.Get("author"),
+		Changes:   q["changes"],
+		Config:    config,
+	})
+	if err != nil {
+		return err
+	}
+	writeJSON(w, http.StatusCreated, resp)
+	return nil
+}
+
+func (s *Server) pullImage(w http.ResponseWriter, r *http.Request) error {
+	q := r.URL.Query()
+	ref := q.Get("fromImage")
+	if tag := q.Get("tag"); tag != "" {
+		ref += ":" + tag
+	}
+	rc, err := s.Engine.ImagePull(r.Context(), ref, types.ImagePullOptions{})
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	w.Header().Set("Content-Type", "application/json")
+	io.Copy(w, rc)
+	return nil
+}
+
+func (s *Server) inspectImage(w http.ResponseWriter, r *http.Request, name string) error {
+	_, raw, err := s.Engine.ImageInspectWithRaw(r.Context(), name)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(raw)
+	return nil
+}
+
+func (s *Server) build(w http.ResponseWriter, r *http.Request) error {
+	resp, err := s.Engine.ImageBuild(r.Context(), r.Body, types.ImageBuildOptions{Tags: r.URL.Query()["t"]})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	w.Header().Set("Content-Type", "application/json")
+	io.Copy(w, resp.Body)
+	return nil
+}
+
+// hijack takes over the connection of the request to carry the streams of
+// the attached connection hr, as the attach endpoints of the Docker engine
+// do.
+func hijack(w http.ResponseWriter, hr types.HijackedResponse, multiplexed bool) {
+	conn, rw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		hr.Close()
+		writeError(w, err)
+		return
+	}
+	contentType := "application/vnd.docker.raw-stream"
+	if multiplexed {
+		contentType = "application/vnd.docker.multiplexed-stream"
+	}
+	fmt.Fprintf(rw, "HTTP/1.1 101 UPGRADED\r\nContent-Type: %s\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n", contentType)
+	if err := rw.Flush(); err != nil {
+		hr.Close()
+		conn.Close()
+		return
+	}
+	go pipe(conn, rw.Reader, hr)
+}
+
+// pipe copies the standard input from the client connection to hr and the
+// output back, until the client hangs up.
+func pipe(conn net.Conn, r *bufio.Reader, hr types.HijackedResponse) {
+	defer conn.Close()
+	defer hr.Close()
+	stdinDone := make(chan struct{})
+	go func() {
+		io.Copy(hr.Conn, r)
+		hr.CloseWrite()
+		close(stdinDone)
+	}()
+	if _, err := io.Copy(conn, hr.Reader); err != nil {
+		return
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		cw.CloseWrite()
+	}
+	<-stdinDone
+}
+
+// parseFilters parses the filters query parameter, in both the current
+// {"key":{"value":true}} and the legacy {"key":["value"]} format.
+func parseFilters(s string) (filters.Args, error) {
+	args := filters.NewArgs()
+	if s == "" {
+		return args, nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(s), &fields); err != nil {
+		return args, invalidParameterError{"invalid filters: " + err.Error()}
+	}
+	for key, raw := range fields {
+		var set map[string]bool
+		if err := json.Unmarshal(raw, &set); err == nil {
+			for value := range set {
+				args.Add(key, value)
+			}
+			continue
+		}
+		var list []string
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return args, invalidParameterError{"invalid filters: " + err.Error()}
+		}
+		for _, value := range list {
+			args.Add(key, value)
+		}
+	}
+	return args, nil
+}
+
+// boolValue reports whether the query parameter is set to a true value, the
+// way the Docker engine parses them.
+func boolValue(q url.Values, key string) bool {
+	v := strings.ToLower(strings.TrimSpace(q.Get(key)))
+	return v != "" && v != "0" && v != "no" && v != "false" && v != "none"
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError responds with the status of the error like the Docker engine.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	var (
+		notFound interface{ NotFound() bool }
+		conflict interface{ Conflict() bool }
+		invalid  interface{ InvalidParameter() bool }
+	)
+	switch {
+	case errors.As(err, &notFound):
+		status = http.StatusNotFound
+	case errors.As(err, &conflict):
+		status = http.StatusConflict
+	case errors.As(err, &invalid):
+		status = http.StatusBadRequest
+	}
+	writeJSON(w, status, map[string]string{"message": err.Error()})
+}
@@ -0,0 +1,104 @@
+package dexec
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"strings"
+)
+
+// ChangeKind is the kind of a filesystem change in the container.
+type ChangeKind int
+
+// The values match the ones used by the Docker API.
+const (
+	ChangeModify ChangeKind = iota
+	ChangeAdd
+	ChangeDelete
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeModify:
+		return "C"
+	case ChangeAdd:
+		return "A"
+	case ChangeDelete:
+		return "D"
+	}
+	return "?"
+}
+
+// Change is a filesystem change in the container made while it was running.
+type Change struct {
+	Kind ChangeKind
+	Path string
+}
+
+func (c Change) String() string { return c.Kind.String() + " " + c.Path }
+
+// Differ is implemented by executions that can report the changes made to the
+// filesystem of the container of the command. Cmd uses it for
+// Cmd.ReportChanges.
+//
+// Only ByCreatingContainer implements it, as the changes of a container the
+// command was exec'd in are not limited to the ones of the command.
+type Differ interface {
+	Diff(ctx context.Context, d Docker) ([]Change, error)
+}
+
+func (c *createContainer) Diff(ctx context.Context, d Docker) ([]Change, error) {
+	if c.id == "" {
+		return nil, ErrNotCreated
+	}
+	items, err := d.Client.ContainerDiff(ctx, c.id)
+	if err != nil {
+		return nil, &PhaseError{Phase: PhaseDiff, ContainerID: c.id, Err: err}
+	}
+	changes := make([]Change, len(items))
+	for i, item := range items {
+		changes[i] = Change{Kind: ChangeKind(item.Kind), Path: item.Path}
+	}
+	return changes, nil
+}
+
+// exportChanges writes the added and modified paths to w as a tar stream.
+// Directories are written without their contents, deleted paths are omitted.
+func exportChanges(ctx context.Context, d Docker, fc FileCopier, changes []Change, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	for _, ch := range changes {
+		if ch.Kind == ChangeDelete {
+			continue
+		}
+		if err := exportChange(ctx, d, fc, ch.Path, tw); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func exportChange(ctx context.Context, d Docker, fc FileCopier, p string, tw *tar.Writer) error {
+	rc, err := fc.CopyFrom(ctx, d, p)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	// the first entry is the path itself
+	tr := tar.NewReader(rc)
+	hdr, err := tr.Next()
+	if err == io.EOF {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	hdr.Name = strings.TrimPrefix(p, "/")
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		return nil
+	}
+	_, err = io.Copy(tw, tr)
+	return err
+}
@@ -15,13 +15,4 @@
 //
 // The package needs the following dependencies to work:
 //  go get github.com/fsouza/go-dockerclient
-//
-// Known issues
-//
-// - You may receive empty stdout/stderr from commands if the executed command
-// does not end with a trailing new line or has a different flushing behavior.
-//
-// - StdinPipe/StdoutPipe/StderrPipe should be used with goroutines (one that
-// executes Cmd.Wait() and another one that writes to/reads from the pipe.
-// Otherwise, the code may hang 10% of the time due to some timing issue.
 package dexec
@@ -0,0 +1,134 @@
+package dexec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	docker "github.com/docker/docker/client"
+)
+
+var (
+	// ErrAlreadyStarted is returned by Cmd.Start if the command was started
+	// before.
+	ErrAlreadyStarted = errors.New("dexec: already started")
+
+	// ErrNotStarted is returned when an operation needs a started command.
+	ErrNotStarted = errors.New("dexec: not started")
+
+	// ErrAlreadyWaited is returned by Cmd.Wait if it was called before.
+	ErrAlreadyWaited = errors.New("dexec: Wait was already called")
+
+	// ErrNotCreated is returned by an Execution when an operation needs the
+	// command to be created first.
+	ErrNotCreated = errors.New("dexec: container is not created")
+
+	// ErrStdinAlreadySet, ErrStdoutAlreadySet and ErrStderrAlreadySet are
+	// returned by the methods of Cmd that set the corresponding stream if it
+	// was already set.
+	ErrStdinAlreadySet  = errors.New("dexec: Stdin already set")
+	ErrStdoutAlreadySet = errors.New("dexec: Stdout already set")
+	ErrStderrAlreadySet = errors.New("dexec: Stderr already set")
+
+	// ErrConfigNil is returned when a container configuration is missing.
+	ErrConfigNil = errors.New("dexec: Config is nil")
+
+	// ErrImageNotFound is wrapped in the error returned when the image of a
+	// container does not exist on the Docker engine and is not pulled.
+	ErrImageNotFound = errors.New("dexec: image not found")
+
+	// ErrSignalNotSupported is returned when the execution strategy cannot
+	// deliver signals to the command.
+	ErrSignalNotSupported = errors.New("dexec: signals are not supported by the execution")
+
+	// ErrCopyNotSupported is returned when Cmd.Inputs or Cmd.Outputs are set
+	// but the execution strategy does not implement FileCopier.
+	ErrCopyNotSupported = errors.New("dexec: copying files is not supported by the execution")
+
+	// ErrDiffNotSupported is returned when Cmd.ReportChanges is set but the
+	// execution strategy does not implement Differ.
+	ErrDiffNotSupported = errors.New("dexec: reporting changes is not supported by the execution")
+
+	// ErrResizeNotSupported is returned from Cmd.Resize when the execution
+	// strategy does not implement Resizer.
+	ErrResizeNotSupported = errors.New("dexec: resizing the terminal is not supported by the execution")
+
+	// ErrWaitDelay is returned from Cmd.Wait when the command succeeded but
+	// its output was not drained within Cmd.WaitDelay.
+	ErrWaitDelay = errors.New("dexec: WaitDelay expired before I/O complete")
+
+	// ErrPoolClosed is returned when a container is requested from a closed
+	// Pool.
+	ErrPoolClosed = errors.New("dexec: pool is closed")
+)
+
+// Phase identifies a step in the lifecycle of a command.
+type Phase string
+
+// Phases reported in PhaseError.
+const (
+	PhasePull   Phase = "pull"
+	PhaseBuild  Phase = "build"
+	PhaseCreate Phase = "create"
+	PhaseStart  Phase = "start"
+	PhaseAttach Phase = "attach"
+	PhaseStdin  Phase = "stdin"
+	PhaseCopy   Phase = "copy"
+	PhaseWait   Phase = "wait"
+	PhaseResize Phase = "resize"
+	PhaseDiff   Phase = "diff"
+	PhaseCommit Phase = "commit"
+	PhaseKill   Phase = "kill"
+	PhaseRemove Phase = "remove"
+)
+
+var phaseMessages = map[Phase]string{
+	PhasePull:   "failed to pull image",
+	PhaseBuild:  "failed to build image",
+	PhaseCreate: "failed to create container",
+	PhaseStart:  "failed to start container",
+	PhaseAttach: "failed to attach container",
+	PhaseStdin:  "failed to copy standard input to container",
+	PhaseCopy:   "failed to copy files of container",
+	PhaseWait:   "cannot wait for container",
+	PhaseResize: "failed to resize terminal of container",
+	PhaseDiff:   "failed to inspect changes of container",
+	PhaseCommit: "failed to commit container",
+	PhaseKill:   "failed to signal container",
+	PhaseRemove: "error deleting container",
+}
+
+// PhaseError records a failed step of the lifecycle of a command and the
+// error that caused it, which is usually returned by the Docker client.
+type PhaseError struct {
+	Phase Phase
+
+	// ContainerID is the ID (or name) of the container, if it is known at
+	// the time of the failure.
+	ContainerID string
+
+	Err error
+}
+
+func (e *PhaseError) Error() string {
+	msg, ok := phaseMessages[e.Phase]
+	if !ok {
+		msg = string(e.Phase) + " failed"
+	}
+	return fmt.Sprintf("dexec: %s: %v", msg, e.Err)
+}
+
+func (e *PhaseError) Unwrap() error { return e.Err }
+
+// createError wraps an error returned from creating a container of the image.
+// The Docker API responds with "not found" to a create request if the image
+// does not exist, but also if a network or a volume driver does not, so the
+// image is inspected to tell them apart.
+func createError(ctx context.Context, d Docker, image string, err error) error {
+	if docker.IsErrNotFound(err) {
+		if _, _, ierr := d.Client.ImageInspectWithRaw(ctx, image); docker.IsErrNotFound(ierr) {
+			err = fmt.Errorf("%w: %w", ErrImageNotFound, err)
+		}
+	}
+	return &PhaseError{Phase: PhaseCreate, Err: err}
+}
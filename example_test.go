@@ -4,23 +4,23 @@ import (
 	"fmt"
 	"log"
 
-	"github.com/ahmetalpbalkan/go-dexec"
-	"github.com/fsouza/go-dockerclient"
+	containertypes "github.com/docker/docker/api/types/container"
+	docker "github.com/docker/docker/client"
+	dexec "github.com/silentred/go-dexec"
 )
 
+// The example needs a Docker engine, so it is compiled but not run by go test.
 func ExampleCmd_Output() {
-	cl, _ := docker.NewClient("unix:///var/run/docker.sock")
+	cl, _ := docker.NewEnvClient()
 	d := dexec.Docker{cl}
 
-	m, _ := dexec.ByCreatingContainer(docker.CreateContainerOptions{
-		Config: &docker.Config{Image: "busybox"}})
+	m, _ := dexec.ByCreatingContainer(dexec.CreateContainerOption{
+		Config: &containertypes.Config{Image: "busybox"}})
 
 	cmd := d.Command(m, "echo", `I am running inside a container!`)
 	b, err := cmd.Output()
 	if err != nil {
 		log.Fatal(err)
 	}
-	fmt.Printf("%s", b)
-
-	// Output: I am running inside a container!
+	fmt.Printf("%s", b) // I am running inside a container!
 }
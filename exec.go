@@ -0,0 +1,274 @@
+package dexec
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	types "github.com/docker/docker/api/types"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// ExecOption configures the processes started by ByExecInContainer.
+type ExecOption struct {
+	// User is the user (and optionally the group, as "user:group") the
+	// command runs as. If empty, the user of the container is used.
+	User string
+
+	// Privileged gives extended privileges to the command.
+	Privileged bool
+
+	// Env is the environment variables of the command in addition to the
+	// ones of the container.
+	Env []string
+
+	// WorkingDir is the working directory of the command. If empty, the
+	// working directory of the container is used.
+	WorkingDir string
+
+	// Tty allocates a pseudo-terminal for the command. Its standard output
+	// and standard error are then both written to Cmd.Stdout.
+	Tty bool
+}
+
+type execInContainer struct {
+	container string
+	opt       ExecOption
+	cmd       []string
+	id        string // exec instance id
+	token     string // value of ExecEnv
+	startedAt time.Time
+
+	mu      sync.Mutex // guards hr and cleaned against Kill
+	hr      types.HijackedResponse
+	cleaned bool
+}
+
+// ExecEnv is the environment variable set for the commands run by
+// ByExecInContainer, with a value unique to each command, by which signals
+// are delivered to them.
+const ExecEnv = "DEXEC_EXEC"
+
+// ByExecInContainer is the execution strategy where the command is executed
+// inside an already running container, identified by its ID or name, using the
+// exec API of Docker.
+//
+// The container is not modified or removed after the command exits. The exec
+// API does not support signalling, so signals are sent by another exec
+// instance running kill(1) in the container, which requires sh, tr, grep and
+// kill in the image and /proc mounted, as with busybox or most distributions.
+// The process is found by its ExecEnv variable rather than by the pid reported
+// by the exec API, which is the one of the host.
+func ByExecInContainer(container string, opts ExecOption) (Execution, error) {
+	if container == "" {
+		return nil, errors.New("dexec: container is not specified")
+	}
+	return &execInContainer{container: container, opt: opts}, nil
+}
+
+func (e *execInContainer) SetEnv(env []string) error {
+	if len(e.opt.Env) > 0 {
+		return errors.New("dexec: ExecOption.Env already set")
+	}
+	e.opt.Env = env
+	return nil
+}
+
+func (e *execInContainer) SetDir(dir string) error {
+	if e.opt.WorkingDir != "" {
+		return errors.New("dexec: ExecOption.WorkingDir already set")
+	}
+	e.opt.WorkingDir = dir
+	return nil
+}
+
+func (e *execInContainer) Create(ctx context.Context, d Docker, cmd []string) error {
+	e.cmd = cmd
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return &PhaseError{Phase: PhaseCreate, ContainerID: e.container, Err: err}
+	}
+	e.token = hex.EncodeToString(b)
+	resp, err := d.Client.ContainerExecCreate(ctx, e.container, types.ExecConfig{
+		User:         e.opt.User,
+		Privileged:   e.opt.Privileged,
+		Env:          append(append([]string(nil), e.opt.Env...), ExecEnv+"="+e.token),
+		WorkingDir:   e.opt.WorkingDir,
+		Tty:          e.opt.Tty,
+		Cmd:          cmd,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return &PhaseError{Phase: PhaseCreate, ContainerID: e.container, Err: err}
+	}
+	e.id = resp.ID
+	return nil
+}
+
+// Attach starts the exec instance, as the Docker API attaches to the standard
+// streams of an exec instance only as it is started.
+func (e *execInContainer) Attach(ctx context.Context, d Docker) (*Streams, error) {
+	if e.id == "" {
+		return nil, ErrNotCreated
+	}
+	hr, err := d.Client.ContainerExecAttach(ctx, e.id, types.ExecStartCheck{Tty: e.opt.Tty})
+	if err != nil {
+		return nil, &PhaseError{Phase: PhaseStart, ContainerID: e.container, Err: err}
+	}
+	e.mu.Lock()
+	e.hr = hr
+	e.mu.Unlock()
+	e.startedAt = time.Now()
+	streams := HijackedStreams(hr)
+	streams.Multiplexed = !e.opt.Tty
+	return streams, nil
+}
+
+// Start does nothing as the exec instance is started by Attach.
+func (e *execInContainer) Start(ctx context.Context, d Docker) error {
+	if e.hr.Conn == nil {
+		return ErrNotCreated
+	}
+	return nil
+}
+
+// execPollInterval is how often the exec instance is inspected while waiting
+// for it to exit.
+const execPollInterval = 50 * time.Millisecond
+
+// Wait polls the exec instance until it exits. The exec API reports neither
+// the times nor the out of memory condition, so the times are measured on the
+// client.
+func (e *execInContainer) Wait(ctx context.Context, d Docker) (ExitStatus, error) {
+	status := ExitStatus{ExitCode: -1}
+	if e.id == "" {
+		return status, ErrNotCreated
+	}
+	resp, err := waitExec(ctx, d, e.id)
+	if err != nil {
+		if err == ctx.Err() {
+			return status, err
+		}
+		return status, &PhaseError{Phase: PhaseWait, ContainerID: e.container, Err: err}
+	}
+	status.ExitCode = resp.ExitCode
+	status.StartedAt = e.startedAt
+	status.FinishedAt = time.Now()
+	if status.ExitCode != 0 {
+		// best effort, only needed to describe the failure
+		if info, err := d.Client.ContainerInspect(ctx, e.container); err == nil && info.Config != nil {
+			status.Image = info.Config.Image
+		}
+	}
+	return status, nil
+}
+
+// waitExec polls the exec instance until it exits.
+func waitExec(ctx context.Context, d Docker, id string) (types.ContainerExecInspect, error) {
+	for {
+		resp, err := d.Client.ContainerExecInspect(ctx, id)
+		if err != nil || !resp.Running {
+			return resp, err
+		}
+		select {
+		case <-ctx.Done():
+			return resp, ctx.Err()
+		case <-time.After(execPollInterval):
+		}
+	}
+}
+
+func (e *execInContainer) ContainerID() string { return e.container }
+
+func (e *execInContainer) CopyTo(ctx context.Context, d Docker, dst string, archive io.Reader) error {
+	return copyToContainer(ctx, d, e.container, dst, archive)
+}
+
+func (e *execInContainer) CopyFrom(ctx context.Context, d Docker, src string) (io.ReadCloser, error) {
+	return copyFromContainer(ctx, d, e.container, src)
+}
+
+// killScript sends the signal $1 to the process of the container whose
+// ExecEnv variable is $2 and whose parent is outside of the container, that is
+// the process started by the exec instance rather than one of its children.
+const killScript = `sig=$1 env=` + ExecEnv + `=$2
+for d in /proc/[0-9]*; do
+	{ tr '\0' '\n' <"$d/environ"; } 2>/dev/null | grep -qxF "$env" || continue
+	{ read -r stat <"$d/stat"; } 2>/dev/null || continue
+	set -- ${stat##*") "}
+	[ "$2" = 0 ] && exec kill -s "$sig" "${d#/proc/}"
+done
+echo "no such process" >&2
+exit 1`
+
+func (e *execInContainer) Kill(ctx context.Context, d Docker, signal string) error {
+	e.mu.Lock()
+	started, cleaned := e.hr.Conn != nil, e.cleaned
+	e.mu.Unlock()
+	if cleaned {
+		return os.ErrProcessDone
+	}
+	if !started {
+		return ErrNotCreated
+	}
+	resp, err := d.Client.ContainerExecInspect(ctx, e.id)
+	if err != nil {
+		return &PhaseError{Phase: PhaseKill, ContainerID: e.container, Err: err}
+	}
+	if !resp.Running {
+		return os.ErrProcessDone
+	}
+	kill, err := d.Client.ContainerExecCreate(ctx, e.container, types.ExecConfig{
+		User:         e.opt.User,
+		Privileged:   e.opt.Privileged,
+		Cmd:          []string{"sh", "-c", killScript, "kill", strings.TrimPrefix(signal, "SIG"), e.token},
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return &PhaseError{Phase: PhaseKill, ContainerID: e.container, Err: err}
+	}
+	hr, err := d.Client.ContainerExecAttach(ctx, kill.ID, types.ExecStartCheck{})
+	if err != nil {
+		return &PhaseError{Phase: PhaseKill, ContainerID: e.container, Err: err}
+	}
+	defer hr.Close()
+	var out bytes.Buffer
+	if _, err := stdcopy.StdCopy(&out, &out, hr.Reader); err != nil {
+		return &PhaseError{Phase: PhaseKill, ContainerID: e.container, Err: err}
+	}
+	resp, err = waitExec(ctx, d, kill.ID)
+	if err != nil {
+		return &PhaseError{Phase: PhaseKill, ContainerID: e.container, Err: err}
+	}
+	if resp.ExitCode != 0 {
+		// the command may have exited in the meantime
+		if resp, err := d.Client.ContainerExecInspect(ctx, e.id); err == nil && !resp.Running {
+			return os.ErrProcessDone
+		}
+		return &PhaseError{Phase: PhaseKill, ContainerID: e.container,
+			Err: fmt.Errorf("dexec: kill exited with status %d: %s", resp.ExitCode, bytes.TrimSpace(out.Bytes()))}
+	}
+	return nil
+}
+
+func (e *execInContainer) Cleanup(ctx context.Context, d Docker) error {
+	e.mu.Lock()
+	hr := e.hr
+	e.hr, e.cleaned = types.HijackedResponse{}, true
+	e.mu.Unlock()
+	if hr.Conn != nil {
+		hr.Close()
+	}
+	return nil
+}
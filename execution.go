@@ -3,31 +3,164 @@ package dexec
 import (
 	"context"
 	"errors"
-	"fmt"
 	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
 
 	types "github.com/docker/docker/api/types"
 	containertypes "github.com/docker/docker/api/types/container"
 	networktypes "github.com/docker/docker/api/types/network"
-	"github.com/docker/docker/pkg/stdcopy"
 )
 
-// Execution determines how the command is going to be executed. Currently
-// the only method is ByCreatingContainer.
+// Execution determines how the command is going to be executed. Cmd drives an
+// Execution through its lifecycle in the following order:
+//
+//	SetDir, SetEnv (optional), Create, Attach, Start, Wait, Cleanup
+//
+// Cleanup is called even if one of the earlier steps fails after Create
+// succeeded. These methods are called in sequence, but Kill may be called at
+// any time after Start from another goroutine, e.g. by Process.Signal: it must
+// be safe to call concurrently with Wait and Cleanup, and return
+// os.ErrProcessDone once Cleanup is called.
+//
+// ByCreatingContainer, ByExecInContainer and ByLocalProcess are the built-in
+// implementations; other strategies can be provided by implementing this
+// interface.
 type Execution interface {
-	create(d Docker, cmd []string) error
-	run(d Docker, stdin io.Reader, stdout, stderr io.Writer) error
-	wait(d Docker) (int, error)
+	// Create prepares cmd (the program name followed by its arguments) for
+	// execution, e.g. by creating a container.
+	Create(ctx context.Context, d Docker, cmd []string) error
+
+	// Attach returns the standard stream handles of the command prepared
+	// with Create. It is called before Start so that no output is missed.
+	Attach(ctx context.Context, d Docker) (*Streams, error)
+
+	// Start starts the command prepared with Create.
+	Start(ctx context.Context, d Docker) error
+
+	// Wait blocks until the command exits and returns its exit status. Cmd
+	// calls Wait while the output streams returned by Attach are still being
+	// copied.
+	Wait(ctx context.Context, d Docker) (ExitStatus, error)
+
+	// Kill sends the signal (such as "SIGTERM" or "SIGKILL") to the command.
+	Kill(ctx context.Context, d Docker, signal string) error
+
+	// Cleanup releases all resources associated with the execution, such as
+	// the connections returned by Attach or the container itself.
+	Cleanup(ctx context.Context, d Docker) error
+
+	// ContainerID returns the ID (or name) of the container the command runs
+	// in, once it is created.
+	ContainerID() string
+
+	// SetEnv sets the environment variables of the command.
+	SetEnv(env []string) error
+
+	// SetDir sets the working directory of the command.
+	SetDir(dir string) error
+}
+
+// Streams holds the standard stream handles of a command attached by an
+// Execution.
+type Streams struct {
+	// Stdin receives the standard input of the command. Closing it signals
+	// EOF to the command. It may be nil if the command has no standard input.
+	Stdin io.WriteCloser
+
+	// Stdout carries the standard output of the command. If Multiplexed is
+	// set, it carries both standard output and standard error framed in the
+	// format of github.com/docker/docker/pkg/stdcopy and Stderr is nil.
+	Stdout io.Reader
+	Stderr io.Reader
+
+	Multiplexed bool
+}
+
+// ExitStatus describes how a command exited, as reported by Execution.Wait.
+type ExitStatus struct {
+	// ExitCode is the exit code of the command.
+	ExitCode int
+
+	// OOMKilled reports whether the command was killed for running out of
+	// memory.
+	OOMKilled bool
+
+	// Image is the image of the container the command ran in, if known.
+	Image string
+
+	// StartedAt and FinishedAt are the times the command started and exited,
+	// if known.
+	StartedAt  time.Time
+	FinishedAt time.Time
+
+	// CommittedImage is the ID of the image the container was committed
+	// to, if any.
+	CommittedImage string
+}
+
+// HijackedStreams returns the Streams of a hijacked connection returned from
+// the attach endpoints of the Docker API.
+func HijackedStreams(hr types.HijackedResponse) *Streams {
+	return &Streams{
+		Stdin:       hijackedStdin{hr},
+		Stdout:      hr.Reader,
+		Multiplexed: true,
+	}
+}
 
-	setEnv(env []string) error
-	setDir(dir string) error
+// hijackedStdin closes only the write side of the connection so that the
+// output can still be read after stdin is closed.
+type hijackedStdin struct {
+	hr types.HijackedResponse
 }
 
+func (w hijackedStdin) Write(b []byte) (int, error) { return w.hr.Conn.Write(b) }
+func (w hijackedStdin) Close() error                { return w.hr.CloseWrite() }
+
 type CreateContainerOption struct {
 	ContainerName    string
 	Config           *containertypes.Config
 	HostConfig       *containertypes.HostConfig
 	NetworkingConfig *networktypes.NetworkingConfig
+
+	// PullPolicy determines when Config.Image is pulled. By default, the
+	// image is never pulled.
+	PullPolicy PullPolicy
+
+	// RegistryAuth, if not nil, is used to authenticate to the registry
+	// while pulling the image.
+	RegistryAuth *types.AuthConfig
+
+	// Auth, if not nil, resolves the credentials of the registry when
+	// RegistryAuth is nil. Use LoadDockerConfig to authenticate the same way
+	// the Docker CLI does.
+	Auth AuthResolver
+
+	// PullProgress, if not nil, is called with the progress reports of
+	// the image pull.
+	PullProgress func(PullProgress)
+
+	// Commit, if not nil, commits the container to a new image once the
+	// command exits successfully, before the container is removed. The ID of
+	// the image is reported by ProcessState.CommittedImage.
+	Commit *CommitOption
+
+	// Retention determines whether the container is kept after the command
+	// exits instead of being removed. A retained container is stopped and
+	// labeled with RetentionTTL, and is removed by Docker.SweepRetained once
+	// the TTL has elapsed since it exited.
+	Retention RetentionPolicy
+
+	// RetentionTTL is how long a retained container is kept. Defaults to
+	// DefaultRetentionTTL.
+	RetentionTTL time.Duration
+
+	// JobID, if not empty, is set as the LabelJobID label of the container,
+	// e.g. to reap the containers of a job with Docker.Reap.
+	JobID string
 }
 
 type AttachContainerOption struct {
@@ -36,28 +169,31 @@ type AttachContainerOption struct {
 }
 
 type createContainer struct {
-	opt CreateContainerOption
-	cmd []string
-	id  string // created container id
-	// cw  *docker.Client
-	stdin          io.Reader
-	stdout, stderr io.Writer
-	hr             types.HijackedResponse
+	opt     CreateContainerOption
+	cmd     []string
+	id      string // created container id, guarded by mu once started
+	hr      types.HijackedResponse
+	pulled  bool
+	success bool // the command exited successfully
+
+	mu      sync.Mutex // guards id and cleaned against Kill and Stop
+	cleaned bool
 }
 
 // ByCreatingContainer is the execution strategy where a new container with specified
 // options is created to execute the command.
 //
 // The container will be created and started with Cmd.Start and will be deleted
-// before Cmd.Wait returns.
+// before Cmd.Wait returns, or as soon as Cmd.Start fails after creating it,
+// unless it is retained according to CreateContainerOption.Retention.
 func ByCreatingContainer(opts CreateContainerOption) (Execution, error) {
 	if opts.Config == nil {
-		return nil, errors.New("dexec: Config is nil")
+		return nil, ErrConfigNil
 	}
 	return &createContainer{opt: opts}, nil
 }
 
-func (c *createContainer) setEnv(env []string) error {
+func (c *createContainer) SetEnv(env []string) error {
 	if len(c.opt.Config.Env) > 0 {
 		return errors.New("dexec: Config.Env already set")
 	}
@@ -65,7 +201,7 @@ func (c *createContainer) setEnv(env []string) error {
 	return nil
 }
 
-func (c *createContainer) setDir(dir string) error {
+func (c *createContainer) SetDir(dir string) error {
 	if c.opt.Config.WorkingDir != "" {
 		return errors.New("dexec: Config.WorkingDir already set")
 	}
@@ -73,8 +209,22 @@ func (c *createContainer) setDir(dir string) error {
 	return nil
 }
 
-func (c *createContainer) create(d Docker, cmd []string) error {
+// Pull pulls the image of the container according to the pull policy.
+func (c *createContainer) Pull(ctx context.Context, d Docker) error {
+	if err := ensureImage(ctx, d, c.opt); err != nil {
+		return err
+	}
+	c.pulled = true
+	return nil
+}
+
+func (c *createContainer) Create(ctx context.Context, d Docker, cmd []string) error {
 	c.cmd = cmd
+	if !c.pulled {
+		if err := c.Pull(ctx, d); err != nil {
+			return err
+		}
+	}
 
 	if len(c.opt.Config.Cmd) > 0 {
 		return errors.New("dexec: Config.Cmd already set")
@@ -90,116 +240,175 @@ func (c *createContainer) create(d Docker, cmd []string) error {
 	c.opt.Config.StdinOnce = true
 	c.opt.Config.Cmd = nil        // clear cmd
 	c.opt.Config.Entrypoint = cmd // set new entrypoint
+	labels := ownerLabels(c.opt.JobID)
+	if c.opt.Retention != RemoveAlways {
+		ttl := c.opt.RetentionTTL
+		if ttl <= 0 {
+			ttl = DefaultRetentionTTL
+		}
+		labels[LabelRetentionTTL] = strconv.FormatInt(int64(ttl/time.Second), 10)
+	}
+	c.opt.Config.Labels = withLabels(c.opt.Config.Labels, labels)
 
-	ctx := context.Background()
 	container, err := d.Client.ContainerCreate(ctx, c.opt.Config, c.opt.HostConfig, c.opt.NetworkingConfig, c.opt.ContainerName)
 	if err != nil {
-		return fmt.Errorf("dexec: failed to create container: %v", err)
+		return createError(ctx, d, c.opt.Config.Image, err)
 	}
 
 	c.id = container.ID
 	return nil
 }
 
-func (c *createContainer) run(d Docker, stdin io.Reader, stdout, stderr io.Writer) error {
-	// fmt.Println("runing...", c.id)
+func (c *createContainer) Start(ctx context.Context, d Docker) error {
 	if c.id == "" {
-		return errors.New("dexec: container is not created")
+		return ErrNotCreated
 	}
-	ctx := context.Background()
 	if err := d.Client.ContainerStart(ctx, c.id, types.ContainerStartOptions{}); err != nil {
-		return fmt.Errorf("dexec: failed to start container:  %v", err)
+		return &PhaseError{Phase: PhaseStart, ContainerID: c.id, Err: err}
 	}
+	return nil
+}
 
-	c.stdin = stdin
-	c.stdout = stdout
-	c.stderr = stderr
-
+func (c *createContainer) Attach(ctx context.Context, d Docker) (*Streams, error) {
+	if c.id == "" {
+		return nil, ErrNotCreated
+	}
 	opts := AttachContainerOption{
 		ContainerID: c.id,
 		AttachOpt: types.ContainerAttachOptions{
 			Stdin:  true,
 			Stdout: true,
 			Stderr: true,
-			Logs:   true,
 			Stream: true,
 		},
 	}
 
-	// opts := docker.AttachToContainerOptions{
-	// 	Container:    c.id,
-	// 	Stdin:        true,
-	// 	Stdout:       true,
-	// 	Stderr:       true,
-	// 	InputStream:  stdin,
-	// 	OutputStream: stdout,
-	// 	ErrorStream:  stderr,
-	// 	Stream:       true,
-	// 	Logs:         true, // include produced output so far
-	// }
-	// fmt.Println("attach...")
-
 	hijackResp, err := d.Client.ContainerAttach(ctx, opts.ContainerID, opts.AttachOpt)
 	if err != nil {
-		return fmt.Errorf("dexec: failed to attach container: %v", err)
+		return nil, &PhaseError{Phase: PhaseAttach, ContainerID: c.id, Err: err}
 	}
 	c.hr = hijackResp
-	// fmt.Println("after attach...")
-	return nil
+	streams := HijackedStreams(hijackResp)
+	streams.Multiplexed = !c.opt.Config.Tty // a TTY merges stdout and stderr
+	return streams, nil
 }
 
-func (c *createContainer) wait(d Docker) (exitCode int, err error) {
-	// fmt.Println("waiting...", c.id)
-	del := func() error {
-		return d.ContainerRemove(context.Background(), c.id, types.ContainerRemoveOptions{Force: true})
-		// return d.RemoveContainer(docker.RemoveContainerOptions{ID: c.id, Force: true})
-	}
-	defer del()
-	if c.hr.Conn == nil {
-		return -1, errors.New("dexec: container is not attached")
-	}
-
-	// keep copying stdin to container
-	// var quit = make(chan int, 1)
-	go func() {
-		// fmt.Println("copy stdin to remote conn")
-		if c.stdin != nil && c.hr.Conn != nil {
-			_, ioErr := io.Copy(c.hr.Conn, c.stdin)
-			if ioErr != nil {
-				fmt.Println(ioErr)
-			}
-			c.hr.CloseWrite()
-		}
-	}()
-
-	if c.hr.Reader != nil {
-		_, err = stdcopy.StdCopy(c.stdout, c.stderr, c.hr.Reader)
-		if err != nil {
-			return -1, fmt.Errorf("dexec: attach error: %v", err)
-		}
+func (c *createContainer) Wait(ctx context.Context, d Docker) (ExitStatus, error) {
+	status := ExitStatus{ExitCode: -1, Image: c.opt.Config.Image}
+	if c.id == "" {
+		return status, ErrNotCreated
 	}
 
-	var statusCode int64
-	var waitOkBodyChan <-chan containertypes.ContainerWaitOKBody
-	var errChan <-chan error
-	waitOkBodyChan, errChan = d.Client.ContainerWait(context.Background(), c.id, containertypes.WaitConditionNotRunning)
+	waitOkBodyChan, errChan := d.Client.ContainerWait(ctx, c.id, containertypes.WaitConditionNotRunning)
 	select {
-	case err = <-errChan:
+	case err := <-errChan:
 		if err != nil {
-			return -1, fmt.Errorf("dexec: cannot wait for container: %v", err)
+			return status, &PhaseError{Phase: PhaseWait, ContainerID: c.id, Err: err}
 		}
 	case waitBody := <-waitOkBodyChan:
-		statusCode = waitBody.StatusCode
 		if waitBody.Error != nil {
-			err = fmt.Errorf(waitBody.Error.Message)
-			return -1, fmt.Errorf("dexec: cannot wait for container: %v", err)
+			return status, &PhaseError{Phase: PhaseWait, ContainerID: c.id, Err: errors.New(waitBody.Error.Message)}
+		}
+		status.ExitCode = int(waitBody.StatusCode)
+	}
+
+	// the details are best effort, the exit code is already known
+	if info, err := d.Client.ContainerInspect(ctx, c.id); err == nil && info.ContainerJSONBase != nil && info.State != nil {
+		status.OOMKilled = info.State.OOMKilled
+		status.StartedAt, _ = time.Parse(time.RFC3339Nano, info.State.StartedAt)
+		status.FinishedAt, _ = time.Parse(time.RFC3339Nano, info.State.FinishedAt)
+	}
+
+	c.success = status.ExitCode == 0
+	if c.opt.Commit != nil && status.ExitCode == 0 {
+		image, err := commitContainer(ctx, d, c.id, c.opt.Commit)
+		if err != nil {
+			return status, err
 		}
+		status.CommittedImage = image
+	}
+	return status, nil
+}
+
+func (c *createContainer) ContainerID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.id
+}
+
+// running returns the ID of the container to signal, or the error of Kill and
+// Stop if there is none.
+func (c *createContainer) running() (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cleaned {
+		return "", os.ErrProcessDone
+	}
+	if c.id == "" {
+		return "", ErrNotCreated
+	}
+	return c.id, nil
+}
+
+func (c *createContainer) CopyTo(ctx context.Context, d Docker, dst string, archive io.Reader) error {
+	return copyToContainer(ctx, d, c.id, dst, archive)
+}
+
+func (c *createContainer) CopyFrom(ctx context.Context, d Docker, src string) (io.ReadCloser, error) {
+	return copyFromContainer(ctx, d, c.id, src)
+}
+
+func (c *createContainer) Kill(ctx context.Context, d Docker, signal string) error {
+	id, err := c.running()
+	if err != nil {
+		return err
+	}
+	if err := d.ContainerKill(ctx, id, signal); err != nil {
+		return &PhaseError{Phase: PhaseKill, ContainerID: id, Err: err}
+	}
+	return nil
+}
+
+// Stop stops the container with the stop API, which returns once the
+// container exited. The engine counts the timeout in whole seconds.
+func (c *createContainer) Stop(ctx context.Context, d Docker, timeout time.Duration) error {
+	id, err := c.running()
+	if err != nil {
+		return err
+	}
+	if err := d.ContainerStop(ctx, id, &timeout); err != nil {
+		return &PhaseError{Phase: PhaseKill, ContainerID: id, Err: err}
 	}
+	return nil
+}
 
-	if err := del(); err != nil {
-		return -1, fmt.Errorf("dexec: error deleting container: %v", err)
+func (c *createContainer) Cleanup(ctx context.Context, d Docker) error {
+	if c.id == "" {
+		return nil
+	}
+	if c.hr.Conn != nil {
+		c.hr.Close()
 	}
+	if c.opt.Retention.retain(c.success) {
+		// the container may still run if waiting for it failed
+		var timeout time.Duration
+		if err := d.ContainerStop(ctx, c.id, &timeout); err != nil {
+			return &PhaseError{Phase: PhaseRemove, ContainerID: c.id, Err: err}
+		}
+		c.forget()
+		return nil
+	}
+	err := d.ContainerRemove(ctx, c.id, types.ContainerRemoveOptions{Force: true})
+	if err != nil {
+		return &PhaseError{Phase: PhaseRemove, ContainerID: c.id, Err: err}
+	}
+	c.forget()
+	return nil
+}
 
-	exitCode = int(statusCode)
-	return exitCode, nil
+// forget clears the ID of the container once it is removed or retained.
+func (c *createContainer) forget() {
+	c.mu.Lock()
+	c.id, c.cleaned = "", true
+	c.mu.Unlock()
 }
@@ -1,18 +1,79 @@
 package dexec
 
-import "fmt"
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
 
 // ExitError reports an unsuccessful exit by a command.
 type ExitError struct {
 	// ExitCode holds the non-zero exit code of the container
 	ExitCode int
 
-	// Stderr holds the standard error output from the command
-	// if it *Cmd executed through Output() and Cmd.Stderr was not
-	// set.
+	// ContainerID is the ID (or name) of the container the command ran in.
+	ContainerID string
+
+	// Image is the image of the container, if known.
+	Image string
+
+	// OOMKilled reports whether the command was killed for running out of
+	// memory.
+	OOMKilled bool
+
+	// Signal is the signal that terminated the command, or nil if the exit
+	// code does not indicate one.
+	Signal os.Signal
+
+	// Duration is the run time of the command, or zero if it is not known.
+	Duration time.Duration
+
+	// Stderr holds the standard error output from the command, regardless of
+	// the method it was run with. Only the first and the last 32 KiB of the
+	// output are kept, the omitted part is replaced with a line noting its
+	// size.
 	Stderr []byte
+
+	// Err, if not nil, is the error of the cancellation of the command: the
+	// error of the context passed to CommandContext, or one wrapping the
+	// error returned by Cmd.Cancel.
+	Err error
 }
 
 func (e *ExitError) Error() string {
-	return fmt.Sprintf("dexec: exit status: %d", e.ExitCode)
+	var details []string
+	if e.Signal != nil {
+		details = append(details, fmt.Sprintf("signal: %v", e.Signal))
+	}
+	if e.OOMKilled {
+		details = append(details, "OOM killed")
+	}
+	if e.ContainerID != "" {
+		details = append(details, "container: "+shortID(e.ContainerID))
+	}
+	if e.Image != "" {
+		details = append(details, "image: "+e.Image)
+	}
+	msg := fmt.Sprintf("dexec: exit status: %d", e.ExitCode)
+	if len(details) > 0 {
+		msg += " (" + strings.Join(details, ", ") + ")"
+	}
+	return msg
 }
+
+// Unwrap returns Err, so that errors.Is reports whether the command was
+// canceled.
+func (e *ExitError) Unwrap() error { return e.Err }
+
+// shortID truncates a container ID the way the Docker CLI displays it.
+func shortID(id string) string {
+	if len(id) == 64 {
+		return id[:12]
+	}
+	return id
+}
+
+// stderrTailSize is the number of bytes kept from the beginning and the end
+// of the standard error for ExitError.
+const stderrTailSize = 32 << 10
@@ -0,0 +1,852 @@
+package dexec_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing/iotest"
+	"time"
+
+	types "github.com/docker/docker/api/types"
+	containertypes "github.com/docker/docker/api/types/container"
+	dexec "github.com/silentred/go-dexec"
+	"github.com/silentred/go-dexec/dexectest"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&FakeTestSuite{})
+
+// FakeTestSuite runs commands on the in-memory engine of package dexectest,
+// it does not need a Docker engine.
+type FakeTestSuite struct {
+	engine *dexectest.Client
+	d      dexec.Docker
+}
+
+func (s *FakeTestSuite) SetUpTest(c *C) {
+	s.engine = dexectest.NewClient()
+	s.engine.AddImage("busybox")
+	s.engine.Handle("echo", func(p *dexectest.Process) int {
+		fmt.Fprintln(p.Stdout, strings.Join(p.Args[1:], " "))
+		return 0
+	})
+	s.engine.Handle("cat", func(p *dexectest.Process) int {
+		io.Copy(p.Stdout, p.Stdin)
+		return 0
+	})
+	s.engine.Handle("tail", dexectest.Idle)
+	s.d = dexec.Docker{Client: s.engine}
+}
+
+func (s *FakeTestSuite) TearDownTest(c *C) {
+	c.Assert(s.engine.Containers(), HasLen, 0)
+}
+
+func (s *FakeTestSuite) container(c *C) dexec.Execution {
+	e, err := dexec.ByCreatingContainer(dexec.CreateContainerOption{
+		Config: &containertypes.Config{Image: "busybox"}})
+	c.Assert(err, IsNil)
+	return e
+}
+
+func (s *FakeTestSuite) TestOutput(c *C) {
+	b, err := s.d.Command(s.container(c), "echo", "arg1", "arg2").Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "arg1 arg2\n")
+}
+
+func (s *FakeTestSuite) TestStdin(c *C) {
+	cmd := s.d.Command(s.container(c), "cat")
+	cmd.Stdin = strings.NewReader("hello")
+	b, err := cmd.Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "hello")
+}
+
+func (s *FakeTestSuite) TestStdinNotReadIgnored(c *C) {
+	s.engine.Handle("print", func(p *dexectest.Process) int {
+		io.WriteString(p.Stdout, "out\n")
+		return 0
+	})
+	cmd := s.d.Command(s.container(c), "print")
+	cmd.Stdin = bytes.NewReader(make([]byte, 1<<20))
+	// the input fails to be written while the output is still being copied
+	cmd.Stdout = slowWriter{io.Discard}
+	c.Assert(cmd.Run(), IsNil)
+}
+
+func (s *FakeTestSuite) TestStdinKillBeforeCleanup(c *C) {
+	errBroken := errors.New("broken source")
+	e := &killTracker{Execution: s.container(c)}
+	cmd := s.d.Command(e, "tail", "-f", "/dev/null")
+	cmd.Stdin = iotest.ErrReader(errBroken)
+	err := cmd.Run()
+	c.Assert(errors.Is(err, errBroken), Equals, true)
+	c.Assert(e.overlap, Equals, false)
+}
+
+// killTracker records whether Cleanup is called while Kill has not returned,
+// which it delays once the command is killed.
+type killTracker struct {
+	dexec.Execution
+	mu      sync.Mutex
+	killing bool
+	overlap bool
+}
+
+func (k *killTracker) Kill(ctx context.Context, d dexec.Docker, signal string) error {
+	k.mu.Lock()
+	k.killing = true
+	k.mu.Unlock()
+	err := k.Execution.Kill(ctx, d, signal)
+	time.Sleep(50 * time.Millisecond)
+	k.mu.Lock()
+	k.killing = false
+	k.mu.Unlock()
+	return err
+}
+
+func (k *killTracker) Cleanup(ctx context.Context, d dexec.Docker) error {
+	k.mu.Lock()
+	k.overlap = k.overlap || k.killing
+	k.mu.Unlock()
+	return k.Execution.Cleanup(ctx, d)
+}
+
+// slowWriter delays the writes to w.
+type slowWriter struct{ w io.Writer }
+
+func (w slowWriter) Write(b []byte) (int, error) {
+	time.Sleep(100 * time.Millisecond)
+	return w.w.Write(b)
+}
+
+// TestNoOutputLost is the hermetic variant of CmdTestSuite.TestNoOutputLost.
+// Through ServerTestSuite, it covers the attach before the start and the
+// hijacked streams of the Docker client.
+func (s *FakeTestSuite) TestNoOutputLost(c *C) {
+	s.engine.Handle("print", func(p *dexectest.Process) int {
+		// no trailing newline and an immediate exit
+		io.WriteString(p.Stdout, p.Args[1])
+		io.WriteString(p.Stderr, p.Args[1])
+		io.Copy(p.Stdout, p.Stdin)
+		return 0
+	})
+	const n, workers = 500, 16
+	// c.Assert must not be called by the workers
+	executions := make([]dexec.Execution, n)
+	for i := range executions {
+		executions[i] = s.container(c)
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				cmd := s.d.Command(executions[i], "print", strconv.Itoa(i))
+				cmd.Stdin = strings.NewReader("-in")
+				var stdout, stderr bytes.Buffer
+				cmd.Stdout, cmd.Stderr = &stdout, &stderr
+				c.Check(cmd.Run(), IsNil)
+				c.Check(stdout.String(), Equals, strconv.Itoa(i)+"-in")
+				c.Check(stderr.String(), Equals, strconv.Itoa(i))
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+func (s *FakeTestSuite) TestExitError(c *C) {
+	s.engine.Handle("fail", dexectest.Script("out\n", "error\n", 3))
+	cmd := s.d.Command(s.container(c), "fail")
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	err := cmd.Run()
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+	c.Assert(err, ErrorMatches, `dexec: exit status: 3 \(container: \w+, image: busybox\)`)
+	c.Assert(err.(*dexec.ExitError).Stderr, DeepEquals, []byte("error\n"))
+	c.Assert(stdout.String(), Equals, "out\n")
+	c.Assert(cmd.ProcessState.ExitCode(), Equals, 3)
+}
+
+func (s *FakeTestSuite) TestNonExistingCommand(c *C) {
+	err := s.d.Command(s.container(c), "no-such-command").Run()
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+	c.Assert(err.(*dexec.ExitError).ExitCode, Equals, 127)
+}
+
+func (s *FakeTestSuite) TestImageNotFound(c *C) {
+	e, err := dexec.ByCreatingContainer(dexec.CreateContainerOption{
+		Config: &containertypes.Config{Image: "no-such-image"}})
+	c.Assert(err, IsNil)
+	err = s.d.Command(e, "echo").Run()
+	c.Assert(err, ErrorMatches, `dexec: failed to create container: dexec: image not found: .*`)
+}
+
+func (s *FakeTestSuite) TestWaitAfterFailedStart(c *C) {
+	e, err := dexec.ByCreatingContainer(dexec.CreateContainerOption{
+		Config: &containertypes.Config{Image: "no-such-image"}})
+	c.Assert(err, IsNil)
+	cmd := s.d.Command(e, "echo")
+	c.Assert(errors.Is(cmd.Start(), dexec.ErrImageNotFound), Equals, true)
+	c.Assert(cmd.Wait(), Equals, dexec.ErrNotStarted)
+}
+
+func (s *FakeTestSuite) TestWaitTwice(c *C) {
+	cmd := s.d.Command(s.container(c), "echo")
+	c.Assert(cmd.Run(), IsNil)
+	c.Assert(cmd.Wait(), Equals, dexec.ErrAlreadyWaited)
+}
+
+func (s *FakeTestSuite) TestNetworkNotFound(c *C) {
+	e, err := dexec.ByCreatingContainer(dexec.CreateContainerOption{
+		Config:     &containertypes.Config{Image: "busybox"},
+		HostConfig: &containertypes.HostConfig{NetworkMode: "no-such-network"},
+	})
+	c.Assert(err, IsNil)
+	err = s.d.Command(e, "echo").Run()
+	c.Assert(err, FitsTypeOf, &dexec.PhaseError{})
+	c.Assert(err.(*dexec.PhaseError).Phase, Equals, dexec.PhaseCreate)
+	c.Assert(errors.Is(err, dexec.ErrImageNotFound), Equals, false)
+}
+
+func (s *FakeTestSuite) TestPullIfNotPresent(c *C) {
+	e, err := dexec.ByCreatingContainer(dexec.CreateContainerOption{
+		Config:     &containertypes.Config{Image: "alpine:3"},
+		PullPolicy: dexec.PullIfNotPresent,
+	})
+	c.Assert(err, IsNil)
+	c.Assert(s.d.Command(e, "echo").Run(), IsNil)
+	_, _, err = s.engine.ImageInspectWithRaw(context.Background(), "alpine:3")
+	c.Assert(err, IsNil)
+}
+
+func (s *FakeTestSuite) TestEnvAndDir(c *C) {
+	s.engine.Handle("env", func(p *dexectest.Process) int {
+		fmt.Fprintln(p.Stdout, p.Dir, strings.Join(p.Env, " "))
+		return 0
+	})
+	cmd := s.d.Command(s.container(c), "env")
+	cmd.Dir = "/work"
+	cmd.Env = []string{"A=B"}
+	b, err := cmd.Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "/work A=B\n")
+}
+
+func (s *FakeTestSuite) TestSignal(c *C) {
+	s.engine.Handle("trap", func(p *dexectest.Process) int {
+		fmt.Fprintln(p.Stdout, "ready")
+		fmt.Fprintln(p.Stdout, strings.ToLower(strings.TrimPrefix(<-p.Signals, "SIG")))
+		return 3
+	})
+	cmd := s.d.Command(s.container(c), "trap")
+	out, err := cmd.StdoutPipe()
+	c.Assert(err, IsNil)
+	c.Assert(cmd.Start(), IsNil)
+
+	errc := make(chan error, 1)
+	go func() { errc <- cmd.Wait() }()
+	b := make([]byte, len("ready\n"))
+	_, err = io.ReadFull(out, b)
+	c.Assert(err, IsNil)
+	c.Assert(cmd.Process.Signal(syscall.SIGHUP), IsNil)
+	rest, err := io.ReadAll(out)
+	c.Assert(err, IsNil)
+	c.Assert(string(rest), Equals, "hup\n")
+
+	err = <-errc
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+	c.Assert(err.(*dexec.ExitError).ExitCode, Equals, 3)
+}
+
+func (s *FakeTestSuite) TestStop(c *C) {
+	s.engine.Handle("sleep", func(p *dexectest.Process) int {
+		<-p.Killed // ignores SIGTERM
+		return 0
+	})
+	cmd := s.d.Command(s.container(c), "sleep")
+	c.Assert(cmd.Start(), IsNil)
+
+	errc := make(chan error, 1)
+	go func() { errc <- cmd.Wait() }()
+	c.Assert(cmd.Process.Stop(10*time.Millisecond), IsNil)
+
+	err := <-errc
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+	c.Assert(err.(*dexec.ExitError).ExitCode, Equals, 137)
+	c.Assert(cmd.ProcessState.Signal(), Equals, syscall.SIGKILL)
+}
+
+func (s *FakeTestSuite) TestStopWithoutWait(c *C) {
+	cmd := s.d.Command(s.container(c), "tail", "-f", "/dev/null")
+	c.Assert(cmd.Start(), IsNil)
+	start := time.Now()
+	c.Assert(cmd.Process.Stop(time.Minute), IsNil)
+	c.Assert(time.Since(start) < 10*time.Second, Equals, true)
+
+	err := cmd.Wait()
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+	c.Assert(err.(*dexec.ExitError).ExitCode, Equals, 143)
+}
+
+func (s *FakeTestSuite) TestContextTimeout(c *C) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := s.d.CommandContext(ctx, s.container(c), "tail", "-f", "/dev/null").Run()
+	c.Assert(errors.Is(err, context.DeadlineExceeded), Equals, true)
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+}
+
+func (s *FakeTestSuite) TestRunTimeout(c *C) {
+	cmd := s.d.Command(s.container(c), "tail", "-f", "/dev/null")
+	cmd.Timeouts.Run = 50 * time.Millisecond
+	err := cmd.Run()
+	c.Assert(errors.Is(err, context.DeadlineExceeded), Equals, true)
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+	c.Assert(err.(*dexec.ExitError).ExitCode, Equals, 143)
+}
+
+func (s *FakeTestSuite) TestWaitDelayDuringCancel(c *C) {
+	s.engine.Handle("sleep", func(p *dexectest.Process) int {
+		<-p.Killed // ignores SIGTERM
+		return 0
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := s.d.CommandContext(ctx, s.container(c), "sleep")
+	cmd.StopTimeout = time.Minute
+	cmd.WaitDelay = 10 * time.Millisecond
+	c.Assert(cmd.Start(), IsNil)
+	cancel()
+
+	// killed after WaitDelay, while Cancel waits for StopTimeout
+	start := time.Now()
+	err := cmd.Wait()
+	c.Assert(time.Since(start) < 10*time.Second, Equals, true)
+	c.Assert(errors.Is(err, context.Canceled), Equals, true)
+	c.Assert(err.(*dexec.ExitError).ExitCode, Equals, 137)
+}
+
+func (s *FakeTestSuite) TestInputsOutputsAndChanges(c *C) {
+	s.engine.Handle("upper", func(p *dexectest.Process) int {
+		b, err := p.ReadFile("/in/msg.txt")
+		if err != nil {
+			fmt.Fprintln(p.Stderr, err)
+			return 1
+		}
+		if err := p.WriteFile("/out/msg.txt", bytes.ToUpper(b)); err != nil {
+			fmt.Fprintln(p.Stderr, err)
+			return 1
+		}
+		return 0
+	})
+	dir := c.MkDir()
+	cmd := s.d.Command(s.container(c), "upper")
+	cmd.Inputs = []dexec.Input{{Dest: "/in", Files: map[string][]byte{"msg.txt": []byte("hello")}}}
+	cmd.Outputs = []dexec.Output{{Pattern: "/out/*.txt", HostDir: dir}}
+	cmd.ReportChanges = true
+	c.Assert(cmd.Run(), IsNil)
+
+	b, err := os.ReadFile(filepath.Join(dir, "msg.txt"))
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "HELLO")
+	c.Assert(cmd.ProcessState.Changes(), DeepEquals, []dexec.Change{
+		{Kind: dexec.ChangeAdd, Path: "/in"},
+		{Kind: dexec.ChangeAdd, Path: "/in/msg.txt"},
+		{Kind: dexec.ChangeAdd, Path: "/out"},
+		{Kind: dexec.ChangeAdd, Path: "/out/msg.txt"},
+	})
+}
+
+func (s *FakeTestSuite) TestOutputsSymlinkNotFollowed(c *C) {
+	s.engine.Handle("true", dexectest.Script("", "", 0))
+	outside, dir := c.MkDir(), c.MkDir()
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "a/d", Typeflag: tar.TypeSymlink, Linkname: outside}), IsNil)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "a/f", Typeflag: tar.TypeSymlink, Linkname: filepath.Join(outside, "f")}), IsNil)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "b/d/x", Typeflag: tar.TypeReg, Mode: 0644, Size: 1}), IsNil)
+	_, err := tw.Write([]byte("x"))
+	c.Assert(err, IsNil)
+	c.Assert(tw.WriteHeader(&tar.Header{Name: "b/f", Typeflag: tar.TypeReg, Mode: 0644, Size: 1}), IsNil)
+	_, err = tw.Write([]byte("f"))
+	c.Assert(err, IsNil)
+	c.Assert(tw.Close(), IsNil)
+
+	cmd := s.d.Command(s.container(c), "true")
+	cmd.Inputs = []dexec.Input{{Dest: "/", Archive: &archive}}
+	cmd.Outputs = []dexec.Output{
+		{Pattern: "/a/*", HostDir: dir},
+		{Pattern: "/b/f", HostDir: dir}, // replaces the link f
+		{Pattern: "/b/*", HostDir: dir}, // writes d/x through the link d
+	}
+	c.Assert(cmd.Run(), ErrorMatches, "dexec: refusing to extract through the symbolic link .*")
+
+	entries, err := os.ReadDir(outside)
+	c.Assert(err, IsNil)
+	c.Assert(entries, HasLen, 0)
+	b, err := os.ReadFile(filepath.Join(dir, "f"))
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "f")
+}
+
+func (s *FakeTestSuite) TestCommit(c *C) {
+	s.engine.Handle("touch", func(p *dexectest.Process) int {
+		p.WriteFile(p.Args[1], nil)
+		return 0
+	})
+	e, err := dexec.ByCreatingContainer(dexec.CreateContainerOption{
+		Config: &containertypes.Config{Image: "busybox"},
+		Commit: &dexec.CommitOption{Repo: "committed"},
+	})
+	c.Assert(err, IsNil)
+	cmd := s.d.Command(e, "touch", "/marker")
+	c.Assert(cmd.Run(), IsNil)
+	c.Assert(cmd.ProcessState.CommittedImage(), Not(Equals), "")
+
+	// the file is in the image
+	e, err = dexec.ByCreatingContainer(dexec.CreateContainerOption{
+		Config: &containertypes.Config{Image: "committed"}})
+	c.Assert(err, IsNil)
+	cmd = s.d.Command(e, "cat")
+	cmd.Outputs = []dexec.Output{{Pattern: "/marker", Archive: io.Discard}}
+	c.Assert(cmd.Run(), IsNil)
+}
+
+func (s *FakeTestSuite) TestCommittedImageNotReapable(c *C) {
+	ctx := context.Background()
+	e, err := dexec.ByCreatingContainer(dexec.CreateContainerOption{
+		Config:    &containertypes.Config{Image: "busybox"},
+		Commit:    &dexec.CommitOption{Repo: "committed", Labels: map[string]string{"app": "test"}},
+		JobID:     "job-1",
+		Retention: dexec.KeepAlways,
+	})
+	c.Assert(err, IsNil)
+	cmd := s.d.Command(e, "echo")
+	c.Assert(cmd.Run(), IsNil)
+	kept := cmd.ProcessState.ContainerID()
+	defer s.d.ContainerRemove(ctx, kept, types.ContainerRemoveOptions{Force: true})
+
+	info, _, err := s.d.ImageInspectWithRaw(ctx, "committed")
+	c.Assert(err, IsNil)
+	c.Assert(info.Config.Labels["app"], Equals, "test")
+	c.Assert(info.Config.Labels[dexec.LabelManaged], Equals, "")
+
+	// a container started from the image without dexec is left alone
+	resp, err := s.d.ContainerCreate(ctx, &containertypes.Config{
+		Image:      "committed",
+		Entrypoint: []string{"echo"},
+	}, nil, nil, "")
+	c.Assert(err, IsNil)
+	defer s.d.ContainerRemove(ctx, resp.ID, types.ContainerRemoveOptions{Force: true})
+	removed, err := s.d.Reap(ctx, dexec.ReapFilter{Orphans: true, MaxAge: time.Nanosecond, JobID: "job-1"})
+	c.Assert(err, IsNil)
+	c.Assert(removed, DeepEquals, []string{kept})
+	removed, err = s.d.Reap(ctx, dexec.ReapFilter{MaxAge: time.Nanosecond})
+	c.Assert(err, IsNil)
+	c.Assert(removed, HasLen, 0)
+	removed, err = s.d.SweepRetained(ctx)
+	c.Assert(err, IsNil)
+	c.Assert(removed, HasLen, 0)
+}
+
+func (s *FakeTestSuite) TestTty(c *C) {
+	s.engine.Handle("tty", func(p *dexectest.Process) int {
+		fmt.Fprint(p.Stdout, "out ")
+		fmt.Fprint(p.Stderr, "err")
+		return 0
+	})
+	e, err := dexec.ByCreatingContainer(dexec.CreateContainerOption{
+		Config: &containertypes.Config{Image: "busybox", Tty: true}})
+	c.Assert(err, IsNil)
+	b, err := s.d.Command(e, "tty").Output()
+	c.Assert(err, IsNil)
+	c.Assert(string(b), Equals, "out err")
+}
+
+func (s *FakeTestSuite) TestResize(c *C) {
+	s.engine.Handle("stty", func(p *dexectest.Process) int {
+		<-p.Signals
+		rows, cols := p.Size()
+		fmt.Fprintln(p.Stdout, rows, cols)
+		return 0
+	})
+	e, err := dexec.ByCreatingContainer(dexec.CreateContainerOption{
+		Config: &containertypes.Config{Image: "busybox", Tty: true}})
+	c.Assert(err, IsNil)
+	cmd := s.d.Command(e, "stty")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	c.Assert(cmd.Start(), IsNil)
+	c.Assert(cmd.Resize(24, 80), IsNil)
+	c.Assert(cmd.Process.Signal(syscall.SIGWINCH), IsNil)
+	c.Assert(cmd.Wait(), IsNil)
+	c.Assert(out.String(), Equals, "24 80\n")
+}
+
+func (s *FakeTestSuite) TestExecInContainer(c *C) {
+	ctx := context.Background()
+	resp, err := s.engine.ContainerCreate(ctx, &containertypes.Config{
+		Image:      "busybox",
+		Entrypoint: []string{"tail", "-f", "/dev/null"},
+		Env:        []string{"A=B"},
+	}, nil, nil, "")
+	c.Assert(err, IsNil)
+	defer s.engine.ContainerRemove(ctx, resp.ID, types.ContainerRemoveOptions{Force: true})
+	c.Assert(s.engine.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}), IsNil)
+
+	s.engine.Handle("sh", func(p *dexectest.Process) int {
+		fmt.Fprintln(p.Stdout, p.Env)
+		io.Copy(p.Stdout, p.Stdin)
+		return 7
+	})
+	e, err := dexec.ByExecInContainer(resp.ID, dexec.ExecOption{Env: []string{"C=D"}})
+	c.Assert(err, IsNil)
+	cmd := s.d.Command(e, "sh")
+	cmd.Stdin = strings.NewReader("in\n")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	err = cmd.Run()
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+	c.Assert(err.(*dexec.ExitError).ExitCode, Equals, 7)
+	c.Assert(out.String(), Matches, `\[A=B C=D DEXEC_EXEC=\w+\]\nin\n`)
+}
+
+// execKill emulates the kill script run in the container by
+// ByExecInContainer to signal a command, given the signal and the value of
+// dexec.ExecEnv as the last arguments.
+func execKill(p *dexectest.Process) int {
+	sig, token := p.Args[len(p.Args)-2], p.Args[len(p.Args)-1]
+	for _, proc := range p.Procs() {
+		for _, env := range proc.Env {
+			if proc.Exec && env == dexec.ExecEnv+"="+token {
+				if err := p.Kill(proc.Pid, sig); err != nil {
+					fmt.Fprintln(p.Stderr, err)
+					return 1
+				}
+				return 0
+			}
+		}
+	}
+	return 1
+}
+
+func (s *FakeTestSuite) TestExecSignal(c *C) {
+	ctx := context.Background()
+	resp, err := s.engine.ContainerCreate(ctx, &containertypes.Config{
+		Image:      "busybox",
+		Entrypoint: []string{"tail", "-f", "/dev/null"},
+	}, nil, nil, "")
+	c.Assert(err, IsNil)
+	defer s.engine.ContainerRemove(ctx, resp.ID, types.ContainerRemoveOptions{Force: true})
+	c.Assert(s.engine.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}), IsNil)
+	s.engine.Handle("sh", execKill)
+	s.engine.Handle("trap", func(p *dexectest.Process) int {
+		fmt.Fprintln(p.Stdout, strings.ToLower(strings.TrimPrefix(<-p.Signals, "SIG")))
+		return 3
+	})
+
+	// another command in the container is left alone
+	e, err := dexec.ByExecInContainer(resp.ID, dexec.ExecOption{})
+	c.Assert(err, IsNil)
+	other := s.d.Command(e, "tail", "-f", "/dev/null")
+	c.Assert(other.Start(), IsNil)
+
+	e, err = dexec.ByExecInContainer(resp.ID, dexec.ExecOption{})
+	c.Assert(err, IsNil)
+	cmd := s.d.Command(e, "trap")
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	c.Assert(cmd.Start(), IsNil)
+	c.Assert(cmd.Process.Signal(syscall.SIGHUP), IsNil)
+	err = cmd.Wait()
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+	c.Assert(err.(*dexec.ExitError).ExitCode, Equals, 3)
+	c.Assert(out.String(), Equals, "hup\n")
+	c.Assert(cmd.Process.Signal(syscall.SIGHUP), Equals, os.ErrProcessDone)
+
+	// the context stops the command with the default Cancel
+	c.Assert(other.Process.Kill(), IsNil)
+	c.Assert(other.Wait(), FitsTypeOf, &dexec.ExitError{})
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	e, err = dexec.ByExecInContainer(resp.ID, dexec.ExecOption{})
+	c.Assert(err, IsNil)
+	err = s.d.CommandContext(ctx, e, "tail", "-f", "/dev/null").Run()
+	c.Assert(errors.Is(err, context.DeadlineExceeded), Equals, true)
+	c.Assert(err.(*dexec.ExitError).ExitCode, Equals, 143)
+}
+
+func (s *FakeTestSuite) TestRetention(c *C) {
+	s.engine.Handle("false", dexectest.Script("", "", 1))
+	e, err := dexec.ByCreatingContainer(dexec.CreateContainerOption{
+		Config:       &containertypes.Config{Image: "busybox"},
+		Retention:    dexec.KeepOnFailure,
+		RetentionTTL: time.Nanosecond,
+	})
+	c.Assert(err, IsNil)
+	cmd := s.d.Command(e, "false")
+	c.Assert(cmd.Run(), FitsTypeOf, &dexec.ExitError{})
+	c.Assert(s.engine.Containers(), DeepEquals, []string{cmd.ProcessState.ContainerID()})
+
+	removed, err := s.d.SweepRetained(context.Background())
+	c.Assert(err, IsNil)
+	c.Assert(removed, DeepEquals, []string{cmd.ProcessState.ContainerID()})
+}
+
+func (s *FakeTestSuite) TestKillDuringCleanup(c *C) {
+	ctx := context.Background()
+	resp, err := s.engine.ContainerCreate(ctx, &containertypes.Config{
+		Image:      "busybox",
+		Entrypoint: []string{"tail", "-f", "/dev/null"},
+	}, nil, nil, "")
+	c.Assert(err, IsNil)
+	defer s.engine.ContainerRemove(ctx, resp.ID, types.ContainerRemoveOptions{Force: true})
+	c.Assert(s.engine.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}), IsNil)
+	s.engine.Handle("sh", execKill)
+	exec, err := dexec.ByExecInContainer(resp.ID, dexec.ExecOption{})
+	c.Assert(err, IsNil)
+
+	for _, e := range []dexec.Execution{s.container(c), exec} {
+		cmd := s.d.Command(e, "tail", "-f", "/dev/null")
+		c.Assert(cmd.Start(), IsNil)
+		waited, done := make(chan struct{}), make(chan error)
+		go func() {
+			for {
+				select {
+				case <-waited:
+					done <- e.Kill(ctx, s.d, "SIGKILL")
+					return
+				default:
+					e.Kill(ctx, s.d, "SIGKILL")
+				}
+			}
+		}()
+		c.Assert(cmd.Wait(), FitsTypeOf, &dexec.ExitError{})
+		close(waited)
+		c.Assert(<-done, Equals, os.ErrProcessDone)
+	}
+}
+
+func (s *FakeTestSuite) pool(c *C, opt dexec.PoolOption) *dexec.Pool {
+	opt.Container.Config = &containertypes.Config{Image: "busybox", WorkingDir: "/work"}
+	p, err := dexec.NewPool(s.d, opt)
+	c.Assert(err, IsNil)
+	return p
+}
+
+// eventually fails the test if cond does not become true within a second.
+func eventually(c *C, cond func() bool) {
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			c.Fatal("condition not met")
+		}
+	}
+}
+
+func (s *FakeTestSuite) TestPoolBlocksAtMax(c *C) {
+	p := s.pool(c, dexec.PoolOption{Max: 1})
+	defer p.Close(context.Background())
+	release := make(chan struct{})
+	s.engine.Handle("block", func(*dexectest.Process) int {
+		<-release
+		return 0
+	})
+
+	first := s.d.Command(p.Execution(dexec.ExecOption{}), "block")
+	c.Assert(first.Start(), IsNil)
+	started := make(chan error, 1)
+	second := s.d.Command(p.Execution(dexec.ExecOption{}), "echo")
+	go func() { started <- second.Start() }()
+	select {
+	case <-started:
+		c.Fatal("started beyond Max")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	c.Assert(first.Wait(), IsNil)
+	c.Assert(<-started, IsNil)
+	c.Assert(second.Wait(), IsNil)
+	c.Assert(second.ProcessState.ContainerID(), Not(Equals), first.ProcessState.ContainerID())
+}
+
+func (s *FakeTestSuite) TestPoolRefillsToMin(c *C) {
+	p := s.pool(c, dexec.PoolOption{Min: 2})
+	defer p.Close(context.Background())
+	eventually(c, func() bool { return len(s.engine.Containers()) == 2 })
+
+	cmd := s.d.Command(p.Execution(dexec.ExecOption{}), "echo")
+	c.Assert(cmd.Run(), IsNil)
+	used := cmd.ProcessState.ContainerID()
+	eventually(c, func() bool {
+		ids := s.engine.Containers()
+		return len(ids) == 2 && ids[0] != used && ids[1] != used
+	})
+}
+
+func (s *FakeTestSuite) TestPoolIdleTimeout(c *C) {
+	s.engine.Handle("sh", dexectest.Script("", "", 0))
+	p := s.pool(c, dexec.PoolOption{IdleTimeout: 50 * time.Millisecond, Reset: dexec.ReuseWithCleanDir})
+	defer p.Close(context.Background())
+
+	c.Assert(s.d.Command(p.Execution(dexec.ExecOption{}), "echo").Run(), IsNil)
+	c.Assert(s.engine.Containers(), HasLen, 1)
+	eventually(c, func() bool { return len(s.engine.Containers()) == 0 })
+}
+
+func (s *FakeTestSuite) TestPoolReuseWithCleanDir(c *C) {
+	resets := make(chan string, 2) // the directories emptied by the reset command
+	s.engine.Handle("sh", func(p *dexectest.Process) int {
+		dir := p.Args[len(p.Args)-1]
+		resets <- dir
+		p.RemoveFile(path.Join(dir, "f"))
+		return 0
+	})
+	s.engine.Handle("touch", func(p *dexectest.Process) int {
+		p.WriteFile(path.Join(p.Dir, p.Args[1]), nil)
+		return 0
+	})
+	s.engine.Handle("test-f", func(p *dexectest.Process) int {
+		if _, err := p.ReadFile(path.Join(p.Dir, p.Args[1])); err != nil {
+			return 1
+		}
+		return 0
+	})
+	p := s.pool(c, dexec.PoolOption{Min: 1, Max: 1, Reset: dexec.ReuseWithCleanDir})
+	defer p.Close(context.Background())
+
+	first := s.d.Command(p.Execution(dexec.ExecOption{}), "touch", "f")
+	c.Assert(first.Run(), IsNil)
+	second := s.d.Command(p.Execution(dexec.ExecOption{}), "test-f", "f")
+	err := second.Run()
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{}) // the file was removed
+	c.Assert(err.(*dexec.ExitError).ContainerID, Equals, first.ProcessState.ContainerID())
+	c.Assert(<-resets, Equals, "/work")
+}
+
+func (s *FakeTestSuite) TestPoolDiscardOnKill(c *C) {
+	p := s.pool(c, dexec.PoolOption{Max: 1, Reset: dexec.ReuseWithCleanDir})
+	defer p.Close(context.Background())
+
+	cmd := s.d.Command(p.Execution(dexec.ExecOption{}), "tail", "-f", "/dev/null")
+	c.Assert(cmd.Start(), IsNil)
+	errc := make(chan error, 1)
+	go func() { errc <- cmd.Wait() }()
+	c.Assert(cmd.Process.Kill(), IsNil)
+	err := <-errc
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+	c.Assert(err.(*dexec.ExitError).ExitCode, Equals, 137)
+
+	c.Assert(s.engine.Containers(), HasLen, 0)
+	c.Assert(cmd.Method.Kill(context.Background(), s.d, "SIGKILL"), Equals, os.ErrProcessDone)
+}
+
+func (s *FakeTestSuite) TestPoolCloseWithLeasedContainers(c *C) {
+	p := s.pool(c, dexec.PoolOption{Min: 1})
+	cmd := s.d.Command(p.Execution(dexec.ExecOption{}), "tail", "-f", "/dev/null")
+	c.Assert(cmd.Start(), IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	c.Assert(p.Close(ctx), Equals, context.DeadlineExceeded)
+	c.Assert(s.engine.Containers(), DeepEquals, []string{cmd.Process.ContainerID})
+	_, err := s.d.Command(p.Execution(dexec.ExecOption{}), "echo").Output()
+	c.Assert(err, Equals, dexec.ErrPoolClosed)
+
+	c.Assert(cmd.Process.Kill(), IsNil)
+	c.Assert(cmd.Wait(), NotNil)
+	c.Assert(s.engine.Containers(), HasLen, 0)
+}
+
+func (s *FakeTestSuite) TestLocalProcess(c *C) {
+	s.engine.HandleDefault(dexectest.Local)
+	cmd := s.d.Command(s.container(c), "sh", "-c", `echo "$A"; cat; exit 3`)
+	cmd.Env = []string{"A=B"}
+	cmd.Stdin = strings.NewReader("in\n")
+	b, err := cmd.Output()
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+	c.Assert(err.(*dexec.ExitError).ExitCode, Equals, 3)
+	c.Assert(string(b), Equals, "B\nin\n")
+}
+
+var _ = Suite(&ServerTestSuite{})
+
+// ServerTestSuite runs the tests of FakeTestSuite with the Docker client,
+// through the Engine API served by dexectest.Server.
+type ServerTestSuite struct {
+	FakeTestSuite
+	srv *dexectest.Server
+}
+
+func (s *ServerTestSuite) SetUpTest(c *C) {
+	s.FakeTestSuite.SetUpTest(c)
+	s.srv = dexectest.NewServer(s.engine)
+	cl, err := s.srv.DockerClient()
+	c.Assert(err, IsNil)
+	s.d = dexec.Docker{Client: cl}
+}
+
+func (s *ServerTestSuite) TearDownTest(c *C) {
+	s.FakeTestSuite.TearDownTest(c)
+	s.srv.Close()
+}
+
+func (s *ServerTestSuite) TestRecordReplay(c *C) {
+	s.engine.Handle("greet", func(p *dexectest.Process) int {
+		io.Copy(p.Stdout, p.Stdin)
+		fmt.Fprintln(p.Stderr, "bye")
+		return 3
+	})
+	run := func(srv *dexectest.Server, stdin string, env ...string) error {
+		defer srv.Close()
+		cl, err := srv.DockerClient()
+		c.Assert(err, IsNil)
+		cmd := dexec.Docker{Client: cl}.Command(s.container(c), "greet")
+		cmd.Stdin = strings.NewReader(stdin)
+		cmd.Env = env
+		b, err := cmd.Output()
+		if err, ok := err.(*dexec.ExitError); ok {
+			c.Check(err.ExitCode, Equals, 3)
+			c.Check(err.Stderr, DeepEquals, []byte("bye\n"))
+			c.Check(string(b), Equals, "hello")
+			return srv.Err()
+		}
+		c.Assert(err, NotNil)
+		c.Assert(srv.Err(), NotNil)
+		return srv.Err()
+	}
+
+	cassette := new(dexectest.Cassette)
+	rec, err := dexectest.Record(s.srv.Host(), cassette)
+	c.Assert(err, IsNil)
+	c.Assert(run(rec, "hello"), IsNil)
+	file := filepath.Join(c.MkDir(), "cassette.json")
+	c.Assert(cassette.Save(file), IsNil)
+
+	s.engine.Handle("greet", dexectest.NotFound) // not run again
+	replay := func(stdin string, env ...string) error {
+		cassette, err := dexectest.LoadCassette(file)
+		c.Assert(err, IsNil)
+		return run(dexectest.Replay(cassette), stdin, env...)
+	}
+	c.Assert(replay("hello"), IsNil)
+	c.Assert(replay("hallo"), ErrorMatches, `dexectest: standard input of .* differs from the recorded one: "hallo", recorded "hello"`)
+	c.Assert(replay("hello", "A=1"), ErrorMatches, `dexectest: body of POST .*/containers/create differs from the recorded one: .*`)
+}
@@ -0,0 +1,172 @@
+package dexec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// LocalOption configures the processes started by ByLocalProcess.
+type LocalOption struct {
+	// Env is the environment variables of the command in addition to the
+	// ones of the current process, as the ones of a container are added to
+	// the ones of its image.
+	Env []string
+
+	// Dir is the working directory of the command. If empty, the working
+	// directory of the current process is used.
+	Dir string
+}
+
+type localProcess struct {
+	opt       LocalOption
+	cmd       *exec.Cmd
+	files     []*os.File // the ends of the pipes kept by the current process
+	startedAt time.Time
+}
+
+// ByLocalProcess is the execution strategy where the command is run as a
+// process of the host with os/exec, without Docker, for instance to run the
+// code using dexec where no Docker engine is available. The Docker of the Cmd
+// is not used and may be the zero value.
+//
+// The standard streams, the exit code and the signals of the command behave
+// as with ByCreatingContainer, a command terminated by signal N exits with
+// 128+N. A command that cannot be found fails to start. Inputs, Outputs and
+// ReportChanges are not supported.
+func ByLocalProcess(opts LocalOption) (Execution, error) {
+	return &localProcess{opt: opts}, nil
+}
+
+func (l *localProcess) SetEnv(env []string) error {
+	if len(l.opt.Env) > 0 {
+		return errors.New("dexec: LocalOption.Env already set")
+	}
+	l.opt.Env = env
+	return nil
+}
+
+func (l *localProcess) SetDir(dir string) error {
+	if l.opt.Dir != "" {
+		return errors.New("dexec: LocalOption.Dir already set")
+	}
+	l.opt.Dir = dir
+	return nil
+}
+
+func (l *localProcess) Create(ctx context.Context, d Docker, cmd []string) error {
+	l.cmd = exec.Command(cmd[0], cmd[1:]...)
+	l.cmd.Env = append(os.Environ(), l.opt.Env...)
+	l.cmd.Dir = l.opt.Dir
+	return nil
+}
+
+// Attach creates the pipes of the standard streams. They are not the ones of
+// exec.Cmd, which are closed by its Wait while the output may still be read.
+func (l *localProcess) Attach(ctx context.Context, d Docker) (*Streams, error) {
+	if l.cmd == nil {
+		return nil, ErrNotCreated
+	}
+	var ends [3][2]*os.File // read and write ends of stdin, stdout, stderr
+	for i := range ends {
+		r, w, err := os.Pipe()
+		if err != nil {
+			l.Cleanup(ctx, d)
+			return nil, &PhaseError{Phase: PhaseAttach, Err: err}
+		}
+		ends[i] = [2]*os.File{r, w}
+		l.files = append(l.files, r, w)
+	}
+	l.cmd.Stdin, l.cmd.Stdout, l.cmd.Stderr = ends[0][0], ends[1][1], ends[2][1]
+	return &Streams{
+		Stdin:  ends[0][1],
+		Stdout: ends[1][0],
+		Stderr: ends[2][0],
+	}, nil
+}
+
+func (l *localProcess) Start(ctx context.Context, d Docker) error {
+	if l.cmd == nil || l.cmd.Stdin == nil {
+		return ErrNotCreated
+	}
+	if err := l.cmd.Start(); err != nil {
+		return &PhaseError{Phase: PhaseStart, Err: err}
+	}
+	l.startedAt = time.Now()
+	// the command holds the other ends
+	l.cmd.Stdin.(*os.File).Close()
+	l.cmd.Stdout.(*os.File).Close()
+	l.cmd.Stderr.(*os.File).Close()
+	return nil
+}
+
+func (l *localProcess) Wait(ctx context.Context, d Docker) (ExitStatus, error) {
+	status := ExitStatus{ExitCode: -1}
+	if l.cmd == nil || l.cmd.Process == nil {
+		return status, ErrNotCreated
+	}
+	err := l.cmd.Wait()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		return status, &PhaseError{Phase: PhaseWait, Err: err}
+	}
+	status.ExitCode = l.cmd.ProcessState.ExitCode()
+	if ws, ok := l.cmd.ProcessState.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		status.ExitCode = 128 + int(ws.Signal())
+	}
+	status.StartedAt = l.startedAt
+	status.FinishedAt = time.Now()
+	return status, nil
+}
+
+func (l *localProcess) Kill(ctx context.Context, d Docker, signal string) error {
+	if l.cmd == nil || l.cmd.Process == nil {
+		return ErrNotCreated
+	}
+	sig, err := parseSignal(signal)
+	if err != nil {
+		return &PhaseError{Phase: PhaseKill, Err: err}
+	}
+	if err := l.cmd.Process.Signal(sig); err != nil {
+		if errors.Is(err, os.ErrProcessDone) {
+			return err
+		}
+		return &PhaseError{Phase: PhaseKill, Err: err}
+	}
+	return nil
+}
+
+// parseSignal parses a signal sent with Execution.Kill, by name or number.
+func parseSignal(signal string) (syscall.Signal, error) {
+	if n, err := strconv.Atoi(signal); err == nil {
+		return syscall.Signal(n), nil
+	}
+	name := strings.ToUpper(signal)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	for sig, s := range signalNames {
+		if s == name {
+			return sig, nil
+		}
+	}
+	return 0, fmt.Errorf("dexec: unknown signal %s", signal)
+}
+
+func (l *localProcess) Cleanup(ctx context.Context, d Docker) error {
+	// the ends already closed by Start or Streams.Stdin fail to close again
+	for _, f := range l.files {
+		f.Close()
+	}
+	l.files = nil
+	return nil
+}
+
+// ContainerID returns an empty string, as the command runs on the host.
+func (l *localProcess) ContainerID() string { return "" }
@@ -0,0 +1,104 @@
+package dexec_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	dexec "github.com/silentred/go-dexec"
+	. "gopkg.in/check.v1"
+)
+
+var _ = Suite(&LocalTestSuite{})
+
+// LocalTestSuite runs commands on the host, it does not need a Docker engine.
+type LocalTestSuite struct {
+	d dexec.Docker
+}
+
+func (s *LocalTestSuite) local(c *C) dexec.Execution {
+	e, err := dexec.ByLocalProcess(dexec.LocalOption{})
+	c.Assert(err, IsNil)
+	return e
+}
+
+func (s *LocalTestSuite) TestOutputAndExitError(c *C) {
+	cmd := s.d.Command(s.local(c), "sh", "-c", `cat; echo error >&2; exit 3`)
+	cmd.Stdin = strings.NewReader("hello")
+	b, err := cmd.Output()
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+	c.Assert(err, ErrorMatches, `dexec: exit status: 3`)
+	c.Assert(err.(*dexec.ExitError).Stderr, DeepEquals, []byte("error\n"))
+	c.Assert(string(b), Equals, "hello")
+	c.Assert(cmd.ProcessState.ExitCode(), Equals, 3)
+	c.Assert(cmd.ProcessState.Duration() > 0, Equals, true)
+}
+
+func (s *LocalTestSuite) TestEnvAndDir(c *C) {
+	dir := c.MkDir()
+	e, err := dexec.ByLocalProcess(dexec.LocalOption{Env: []string{"A=B"}})
+	c.Assert(err, IsNil)
+	cmd := s.d.Command(e, "sh", "-c", `echo "$A $PATH"; pwd`)
+	cmd.Dir = dir
+	b, err := cmd.Output()
+	c.Assert(err, IsNil)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	c.Assert(lines, HasLen, 2)
+	c.Assert(strings.HasPrefix(lines[0], "B /"), Equals, true) // PATH of the host
+	c.Assert(lines[1], Equals, dir)
+
+	cmd = s.d.Command(e, "true")
+	cmd.Env = []string{"C=D"}
+	c.Assert(cmd.Run(), ErrorMatches, "dexec: LocalOption.Env already set")
+}
+
+func (s *LocalTestSuite) TestUnreadStdin(c *C) {
+	cmd := s.d.Command(s.local(c), "true")
+	cmd.Stdin = bytes.NewReader(make([]byte, 1<<20))
+	c.Assert(cmd.Run(), IsNil)
+}
+
+func (s *LocalTestSuite) TestNonExistingCommand(c *C) {
+	err := s.d.Command(s.local(c), "no-such-command").Run()
+	c.Assert(err, FitsTypeOf, &dexec.PhaseError{})
+	c.Assert(err.(*dexec.PhaseError).Phase, Equals, dexec.PhaseStart)
+	c.Assert(err, ErrorMatches, ".*executable file not found.*")
+	c.Assert(errors.Is(err, exec.ErrNotFound), Equals, true)
+}
+
+func (s *LocalTestSuite) TestSignal(c *C) {
+	cmd := s.d.Command(s.local(c), "sh", "-c", `trap 'echo hup; exit 3' HUP; echo ready; while :; do sleep 0.01; done`)
+	out, err := cmd.StdoutPipe()
+	c.Assert(err, IsNil)
+	c.Assert(cmd.Start(), IsNil)
+
+	errc := make(chan error, 1)
+	go func() { errc <- cmd.Wait() }()
+	b := make([]byte, len("ready\n"))
+	_, err = io.ReadFull(out, b)
+	c.Assert(err, IsNil)
+	c.Assert(cmd.Process.Signal(syscall.SIGHUP), IsNil)
+	rest, err := io.ReadAll(out)
+	c.Assert(err, IsNil)
+	c.Assert(string(rest), Equals, "hup\n")
+
+	err = <-errc
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+	c.Assert(err.(*dexec.ExitError).ExitCode, Equals, 3)
+}
+
+func (s *LocalTestSuite) TestContextTimeout(c *C) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	cmd := s.d.CommandContext(ctx, s.local(c), "sleep", "10")
+	err := cmd.Run()
+	c.Assert(errors.Is(err, context.DeadlineExceeded), Equals, true)
+	c.Assert(err, FitsTypeOf, &dexec.ExitError{})
+	c.Assert(err.(*dexec.ExitError).ExitCode, Equals, 143)
+	c.Assert(cmd.ProcessState.Signal(), Equals, syscall.SIGTERM)
+}
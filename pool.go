@@ -0,0 +1,510 @@
+package dexec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	types "github.com/docker/docker/api/types"
+	containertypes "github.com/docker/docker/api/types/container"
+)
+
+// ResetPolicy determines what happens to a pooled container after a command
+// executed in it exits.
+type ResetPolicy int
+
+const (
+	// DiscardAfterUse removes the container after it is used by a single
+	// command.
+	DiscardAfterUse ResetPolicy = iota
+
+	// ReuseWithCleanDir empties the working directory of the container and
+	// returns it to the pool after each command.
+	ReuseWithCleanDir
+)
+
+// keepAlive is the entrypoint of pooled containers keeping them running idle
+// while the commands are executed with the exec API.
+var keepAlive = []string{"tail", "-f", "/dev/null"}
+
+// PoolOption configures a Pool.
+type PoolOption struct {
+	// Container is the profile of the pooled containers. ContainerName,
+	// Config.Cmd and Config.Entrypoint must not be set since the containers
+	// are kept running idle with "tail -f /dev/null".
+	//
+	// If HostConfig.Init is not set, it is enabled so that signals sent with
+	// Cmd.Method.Kill terminate the container.
+	Container CreateContainerOption
+
+	// Min is the number of idle containers kept ready in the pool.
+	Min int
+
+	// Max is the maximum number of containers, idle or in use, the pool
+	// manages at once. Requests for more containers block until one is
+	// released. If zero, the number of containers is not limited.
+	Max int
+
+	// IdleTimeout is the time after which an idle container is removed if
+	// there are more than Min idle containers. If zero, idle containers are
+	// kept until the pool is closed.
+	IdleTimeout time.Duration
+
+	// Reset determines what happens to a container after it is used.
+	Reset ResetPolicy
+}
+
+// Pool is a set of warm containers of the same profile that commands are
+// executed in with the exec API, amortizing the cost of creating and starting
+// a container for every command.
+type Pool struct {
+	d   Docker
+	opt PoolOption
+	dir string // the directory emptied between uses
+
+	mu      sync.Mutex
+	idle    []*pooledContainer
+	size    int           // idle, in use and being created containers
+	changed chan struct{} // closed when idle or size changes
+	closed  bool
+
+	refill chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup // running maintenance and reset goroutines
+}
+
+type pooledContainer struct {
+	id        string
+	idleSince time.Time
+}
+
+// NewPool creates a Pool and starts filling it with Min containers in the
+// background. Pool.Close should be called to remove the containers when the
+// pool is no longer used.
+func NewPool(d Docker, opt PoolOption) (*Pool, error) {
+	cfg := opt.Container.Config
+	if cfg == nil {
+		return nil, ErrConfigNil
+	}
+	if opt.Container.ContainerName != "" {
+		return nil, errors.New("dexec: ContainerName cannot be set for pooled containers")
+	}
+	if len(cfg.Cmd) > 0 {
+		return nil, errors.New("dexec: Config.Cmd already set")
+	}
+	if len(cfg.Entrypoint) > 0 {
+		return nil, errors.New("dexec: Config.Entrypoint already set")
+	}
+	if opt.Min < 0 || opt.Max < 0 || (opt.Max > 0 && opt.Min > opt.Max) {
+		return nil, fmt.Errorf("dexec: invalid pool size min=%d max=%d", opt.Min, opt.Max)
+	}
+	if opt.Reset == ReuseWithCleanDir && cfg.WorkingDir == "" {
+		return nil, errors.New("dexec: Config.WorkingDir must be set to reuse containers")
+	}
+
+	p := &Pool{
+		d:       d,
+		opt:     opt,
+		dir:     cfg.WorkingDir,
+		changed: make(chan struct{}),
+		refill:  make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	p.wg.Add(1)
+	go p.maintain()
+	return p, nil
+}
+
+// Execution returns an execution strategy that runs the command in a container
+// leased from the pool with the given options. The container is leased by
+// Cmd.Start, blocking while the pool is at its maximum size, and is returned
+// to the pool by Cmd.Wait.
+//
+// Killing the command kills the entire container and the container is
+// discarded regardless of the reset policy.
+func (p *Pool) Execution(opts ExecOption) Execution {
+	return &pooledExecution{pool: p, opt: opts}
+}
+
+// Close removes the idle containers and waits until the containers in use are
+// released and removed, or the context is done. The pool cannot be used after
+// Close.
+func (p *Pool) Close(ctx context.Context) error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	close(p.done)
+	p.notifyLocked()
+	p.mu.Unlock()
+
+	var firstErr error
+	for _, pc := range idle {
+		if err := p.remove(pc); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	for {
+		p.mu.Lock()
+		size, changed := p.size, p.changed
+		p.mu.Unlock()
+		if size == 0 {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+	p.wg.Wait()
+	return firstErr
+}
+
+// notifyLocked wakes up the goroutines waiting for a change in the pool.
+// p.mu must be held.
+func (p *Pool) notifyLocked() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// get leases an idle container or creates a new one.
+func (p *Pool) get(ctx context.Context) (*pooledContainer, error) {
+	for {
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+		if n := len(p.idle); n > 0 {
+			pc := p.idle[n-1]
+			p.idle = p.idle[:n-1]
+			p.mu.Unlock()
+			p.signalRefill()
+			return pc, nil
+		}
+		if p.opt.Max == 0 || p.size < p.opt.Max {
+			p.size++
+			p.mu.Unlock()
+			pc, err := p.create(ctx)
+			if err != nil {
+				p.mu.Lock()
+				p.size--
+				p.notifyLocked()
+				p.mu.Unlock()
+				return nil, err
+			}
+			return pc, nil
+		}
+		changed := p.changed
+		p.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+// put returns a leased container to the pool, or removes it if it must be
+// discarded.
+func (p *Pool) put(pc *pooledContainer, discard bool) {
+	p.mu.Lock()
+	reuse := !discard && !p.closed && p.opt.Reset == ReuseWithCleanDir
+	if !reuse {
+		p.mu.Unlock()
+		p.remove(pc)
+		p.signalRefill()
+		return
+	}
+	p.wg.Add(1)
+	p.mu.Unlock()
+
+	go func() {
+		defer p.wg.Done()
+		if err := p.reset(pc); err != nil {
+			p.remove(pc)
+			p.signalRefill()
+			return
+		}
+		p.mu.Lock()
+		if p.closed {
+			p.mu.Unlock()
+			p.remove(pc)
+			return
+		}
+		pc.idleSince = time.Now()
+		p.idle = append(p.idle, pc)
+		p.notifyLocked()
+		p.mu.Unlock()
+	}()
+}
+
+// reset empties the working directory of the container.
+func (p *Pool) reset(pc *pooledContainer) error {
+	e, err := ByExecInContainer(pc.id, ExecOption{})
+	if err != nil {
+		return err
+	}
+	return p.d.Command(e, "sh", "-c", `rm -rf -- "$1"/* "$1"/.[!.]* "$1"/..?*`, "sh", p.dir).Run()
+}
+
+func (p *Pool) create(ctx context.Context) (*pooledContainer, error) {
+	cfg := *p.opt.Container.Config
+	cfg.Cmd = nil
+	cfg.Entrypoint = keepAlive
+	cfg.AttachStdin, cfg.AttachStdout, cfg.AttachStderr = false, false, false
+	cfg.OpenStdin, cfg.StdinOnce = false, false
+	cfg.Labels = withLabels(cfg.Labels, ownerLabels(p.opt.Container.JobID))
+
+	var hostCfg containertypes.HostConfig
+	if p.opt.Container.HostConfig != nil {
+		hostCfg = *p.opt.Container.HostConfig
+	}
+	if hostCfg.Init == nil {
+		enabled := true
+		hostCfg.Init = &enabled
+	}
+
+	if err := ensureImage(ctx, p.d, p.opt.Container); err != nil {
+		return nil, err
+	}
+	resp, err := p.d.Client.ContainerCreate(ctx, &cfg, &hostCfg, p.opt.Container.NetworkingConfig, "")
+	if err != nil {
+		return nil, createError(ctx, p.d, cfg.Image, err)
+	}
+	pc := &pooledContainer{id: resp.ID}
+	if err := p.d.Client.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{}); err != nil {
+		p.d.Client.ContainerRemove(context.Background(), resp.ID, types.ContainerRemoveOptions{Force: true})
+		return nil, &PhaseError{Phase: PhaseStart, ContainerID: resp.ID, Err: err}
+	}
+	return pc, nil
+}
+
+// remove removes a container that is no longer tracked as idle.
+func (p *Pool) remove(pc *pooledContainer) error {
+	err := p.d.Client.ContainerRemove(context.Background(), pc.id, types.ContainerRemoveOptions{Force: true})
+	p.mu.Lock()
+	p.size--
+	p.notifyLocked()
+	p.mu.Unlock()
+	if err != nil {
+		return &PhaseError{Phase: PhaseRemove, ContainerID: pc.id, Err: err}
+	}
+	return nil
+}
+
+func (p *Pool) signalRefill() {
+	select {
+	case p.refill <- struct{}{}:
+	default:
+	}
+}
+
+// maintain keeps Min idle containers in the pool and removes the ones that
+// have been idle for longer than IdleTimeout.
+func (p *Pool) maintain() {
+	defer p.wg.Done()
+
+	interval := 30 * time.Second
+	if p.opt.IdleTimeout > 0 && p.opt.IdleTimeout/2 < interval {
+		interval = p.opt.IdleTimeout / 2
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		p.fill()
+		p.expire()
+		select {
+		case <-p.done:
+			return
+		case <-t.C:
+		case <-p.refill:
+		}
+	}
+}
+
+func (p *Pool) fill() {
+	for {
+		p.mu.Lock()
+		if p.closed || len(p.idle) >= p.opt.Min || (p.opt.Max > 0 && p.size >= p.opt.Max) {
+			p.mu.Unlock()
+			return
+		}
+		p.size++
+		p.mu.Unlock()
+
+		pc, err := p.create(context.Background())
+		p.mu.Lock()
+		if err != nil {
+			// retried on the next maintenance round
+			p.size--
+			p.notifyLocked()
+			p.mu.Unlock()
+			return
+		}
+		if p.closed {
+			p.mu.Unlock()
+			p.remove(pc)
+			return
+		}
+		pc.idleSince = time.Now()
+		p.idle = append(p.idle, pc)
+		p.notifyLocked()
+		p.mu.Unlock()
+	}
+}
+
+func (p *Pool) expire() {
+	if p.opt.IdleTimeout <= 0 {
+		return
+	}
+	var expired []*pooledContainer
+	p.mu.Lock()
+	// idle is ordered by release time, oldest first
+	for len(p.idle) > p.opt.Min && time.Since(p.idle[0].idleSince) > p.opt.IdleTimeout {
+		expired = append(expired, p.idle[0])
+		p.idle = p.idle[1:]
+	}
+	p.mu.Unlock()
+	for _, pc := range expired {
+		p.remove(pc)
+	}
+}
+
+type pooledExecution struct {
+	pool *Pool
+	opt  ExecOption
+	exec *execInContainer
+
+	// mu guards the fields below, which Kill uses concurrently with Wait
+	// and Cleanup.
+	mu       sync.Mutex
+	pc       *pooledContainer
+	discard  bool
+	released bool
+}
+
+func (e *pooledExecution) SetEnv(env []string) error {
+	if len(e.opt.Env) > 0 {
+		return errors.New("dexec: ExecOption.Env already set")
+	}
+	e.opt.Env = env
+	return nil
+}
+
+func (e *pooledExecution) SetDir(dir string) error {
+	if e.opt.WorkingDir != "" {
+		return errors.New("dexec: ExecOption.WorkingDir already set")
+	}
+	e.opt.WorkingDir = dir
+	return nil
+}
+
+func (e *pooledExecution) Create(ctx context.Context, d Docker, cmd []string) error {
+	pc, err := e.pool.get(ctx)
+	if err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.pc = pc
+	e.mu.Unlock()
+	e.exec = &execInContainer{container: pc.id, opt: e.opt}
+	if err := e.exec.Create(ctx, d, cmd); err != nil {
+		e.release()
+		return err
+	}
+	return nil
+}
+
+func (e *pooledExecution) Start(ctx context.Context, d Docker) error {
+	if e.exec == nil {
+		return ErrNotCreated
+	}
+	return e.exec.Start(ctx, d)
+}
+
+func (e *pooledExecution) Attach(ctx context.Context, d Docker) (*Streams, error) {
+	if e.exec == nil {
+		return nil, ErrNotCreated
+	}
+	return e.exec.Attach(ctx, d)
+}
+
+func (e *pooledExecution) Wait(ctx context.Context, d Docker) (ExitStatus, error) {
+	if e.exec == nil {
+		return ExitStatus{ExitCode: -1}, ErrNotCreated
+	}
+	status, err := e.exec.Wait(ctx, d)
+	if err != nil {
+		e.mu.Lock()
+		e.discard = true
+		e.mu.Unlock()
+	}
+	return status, err
+}
+
+func (e *pooledExecution) ContainerID() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.pc == nil {
+		return ""
+	}
+	return e.pc.id
+}
+
+func (e *pooledExecution) CopyTo(ctx context.Context, d Docker, dst string, archive io.Reader) error {
+	return copyToContainer(ctx, d, e.ContainerID(), dst, archive)
+}
+
+func (e *pooledExecution) CopyFrom(ctx context.Context, d Docker, src string) (io.ReadCloser, error) {
+	return copyFromContainer(ctx, d, e.ContainerID(), src)
+}
+
+// Kill holds e.mu while killing the container, so that it is not released to
+// the pool, and leased to another command, in the meantime.
+func (e *pooledExecution) Kill(ctx context.Context, d Docker, signal string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.pc == nil {
+		if e.released {
+			return os.ErrProcessDone
+		}
+		return ErrNotCreated
+	}
+	e.discard = true
+	if err := d.ContainerKill(ctx, e.pc.id, signal); err != nil {
+		return &PhaseError{Phase: PhaseKill, ContainerID: e.pc.id, Err: err}
+	}
+	return nil
+}
+
+func (e *pooledExecution) Cleanup(ctx context.Context, d Docker) error {
+	if e.exec != nil {
+		e.exec.Cleanup(ctx, d)
+	}
+	e.release()
+	return nil
+}
+
+func (e *pooledExecution) release() {
+	e.mu.Lock()
+	pc, discard := e.pc, e.discard
+	e.pc = nil
+	e.released = true
+	e.mu.Unlock()
+	if pc != nil {
+		e.pool.put(pc, discard)
+	}
+}
@@ -0,0 +1,184 @@
+package dexec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// Process represents a command started by Cmd.
+//
+// Signals are delivered to the command with Execution.Kill. The container of
+// a Cmd created ByCreatingContainer receives them on its main process, and so
+// does the process of ByLocalProcess, while ByExecInContainer signals the
+// process of the exec instance with kill(1) run in the container.
+type Process struct {
+	// ContainerID is the ID (or name) of the container the command runs in.
+	ContainerID string
+
+	method Execution
+	docker Docker
+	done   <-chan struct{} // closed when the command has exited
+}
+
+// Signal sends a signal to the command. It returns os.ErrProcessDone if the
+// command is known to have exited.
+func (p *Process) Signal(sig os.Signal) error {
+	if p == nil {
+		return ErrNotStarted
+	}
+	if sig == nil {
+		return errors.New("dexec: nil signal")
+	}
+	select {
+	case <-p.done:
+		return os.ErrProcessDone
+	default:
+	}
+	return p.method.Kill(context.Background(), p.docker, signalName(sig))
+}
+
+// Kill causes the command to exit immediately by sending it SIGKILL.
+func (p *Process) Kill() error {
+	return p.Signal(syscall.SIGKILL)
+}
+
+// Stopper is implemented by executions whose engine stops the command itself,
+// such as ByCreatingContainer with the stop API of Docker. Process.Stop uses
+// it instead of sending the signals. Like Execution.Kill, Stop may be called
+// concurrently with Wait and Cleanup.
+type Stopper interface {
+	Stop(ctx context.Context, d Docker, timeout time.Duration) error
+}
+
+// Stop sends SIGTERM, or the stop signal of the container for a Stopper, to
+// the command and SIGKILL if it does not exit within the timeout. Unless the
+// execution is a Stopper, the exit of the command is only observed before the
+// timeout while Cmd.Wait is running concurrently.
+func (p *Process) Stop(timeout time.Duration) error {
+	if p == nil {
+		return ErrNotStarted
+	}
+	if s, ok := p.method.(Stopper); ok {
+		select {
+		case <-p.done:
+			return os.ErrProcessDone
+		default:
+		}
+		return s.Stop(context.Background(), p.docker, timeout)
+	}
+	if err := p.Signal(syscall.SIGTERM); err != nil {
+		return err
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-p.done:
+		return nil
+	case <-t.C:
+	}
+	if err := p.Kill(); !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+	return nil
+}
+
+// signalNames holds the names of the signals defined on all platforms. The
+// names are sent to the Docker engine instead of the numbers since the latter
+// differ between the platforms of the client and the container.
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGTRAP: "SIGTRAP",
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGPIPE: "SIGPIPE",
+	syscall.SIGALRM: "SIGALRM",
+	syscall.SIGTERM: "SIGTERM",
+}
+
+func signalName(sig os.Signal) string {
+	if s, ok := sig.(syscall.Signal); ok {
+		if name, ok := signalNames[s]; ok {
+			return name
+		}
+		return strconv.Itoa(int(s))
+	}
+	return sig.String()
+}
+
+// ProcessState stores information about a command that has exited, as
+// reported by Cmd.Wait.
+type ProcessState struct {
+	containerID string
+	status      ExitStatus
+	changes     []Change
+}
+
+// ContainerID returns the ID (or name) of the container the command ran in.
+func (p *ProcessState) ContainerID() string { return p.containerID }
+
+// ExitCode returns the exit code of the exited command.
+func (p *ProcessState) ExitCode() int { return p.status.ExitCode }
+
+// Success reports whether the command exited successfully.
+func (p *ProcessState) Success() bool { return p.status.ExitCode == 0 }
+
+// OOMKilled reports whether the command was killed for running out of memory.
+// Only ByCreatingContainer reports it.
+func (p *ProcessState) OOMKilled() bool { return p.status.OOMKilled }
+
+// Signal returns the signal that terminated the command, derived from the
+// exit code 128+N reported by the container runtime for a command killed by
+// signal N, or nil if the exit code is not in that range.
+func (p *ProcessState) Signal() os.Signal {
+	if n := p.status.ExitCode - 128; n > 0 && n < 65 {
+		return syscall.Signal(n)
+	}
+	return nil
+}
+
+// Changes returns the changes made to the filesystem of the container, if
+// Cmd.ReportChanges was set.
+func (p *ProcessState) Changes() []Change { return p.changes }
+
+// CommittedImage returns the ID of the image the container was committed to,
+// if CreateContainerOption.Commit was set and the command succeeded.
+func (p *ProcessState) CommittedImage() string { return p.status.CommittedImage }
+
+// StartedAt returns the time the command started, if known.
+func (p *ProcessState) StartedAt() time.Time { return p.status.StartedAt }
+
+// FinishedAt returns the time the command exited, if known.
+func (p *ProcessState) FinishedAt() time.Time { return p.status.FinishedAt }
+
+// Duration returns the run time of the command, or zero if it is not known.
+func (p *ProcessState) Duration() time.Duration {
+	if p.status.StartedAt.IsZero() || p.status.FinishedAt.IsZero() {
+		return 0
+	}
+	return p.status.FinishedAt.Sub(p.status.StartedAt)
+}
+
+func (p *ProcessState) String() string {
+	if p == nil {
+		return "<nil>"
+	}
+	s := fmt.Sprintf("exit status %d", p.status.ExitCode)
+	if sig := p.Signal(); sig != nil {
+		s += fmt.Sprintf(" (signal: %v)", sig)
+	}
+	if p.status.OOMKilled {
+		s += " (OOM killed)"
+	}
+	return s
+}
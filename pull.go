@@ -0,0 +1,142 @@
+package dexec
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"strings"
+
+	types "github.com/docker/docker/api/types"
+	docker "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+)
+
+// PullPolicy determines when the image of a container is pulled.
+type PullPolicy int
+
+const (
+	// PullNever never pulls the image. Creating the container fails with
+	// ErrImageNotFound if the image is not present on the engine.
+	PullNever PullPolicy = iota
+
+	// PullIfNotPresent pulls the image only if it is not present on the
+	// engine.
+	PullIfNotPresent
+
+	// PullAlways pulls the image before every container is created.
+	PullAlways
+)
+
+// PullProgress is a progress report of an image pull.
+type PullProgress struct {
+	// ID is the layer the report is about, or empty for the overall status.
+	ID string
+
+	// Status is a human readable status, such as "Downloading".
+	Status string
+
+	// Current and Total are the transferred and the total number of bytes of
+	// the layer, if known.
+	Current int64
+	Total   int64
+}
+
+// Puller is implemented by executions that may need to pull an image before
+// the command is created. Cmd calls Pull before Execution.Create.
+type Puller interface {
+	Pull(ctx context.Context, d Docker) error
+}
+
+// PullImage pulls the image reference from its registry. If ref has neither a
+// tag nor a digest, the "latest" tag is pulled. auth is used to authenticate
+// to the registry if not nil, and progress is called for every progress
+// report if not nil.
+func (d Docker) PullImage(ctx context.Context, ref string, auth *types.AuthConfig, progress func(PullProgress)) error {
+	opts := types.ImagePullOptions{}
+	if auth != nil {
+		encoded, err := encodeAuth(*auth)
+		if err != nil {
+			return &PhaseError{Phase: PhasePull, Err: err}
+		}
+		opts.RegistryAuth = encoded
+	}
+
+	rc, err := d.Client.ImagePull(ctx, withDefaultTag(ref), opts)
+	if err != nil {
+		return &PhaseError{Phase: PhasePull, Err: err}
+	}
+	defer rc.Close()
+
+	// the pull runs as long as the stream is read, and the errors are only
+	// reported in the stream
+	dec := json.NewDecoder(rc)
+	for {
+		var msg jsonmessage.JSONMessage
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return &PhaseError{Phase: PhasePull, Err: err}
+		}
+		if msg.Error != nil {
+			return &PhaseError{Phase: PhasePull, Err: msg.Error}
+		}
+		if progress != nil {
+			p := PullProgress{ID: msg.ID, Status: msg.Status}
+			if msg.Progress != nil {
+				p.Current, p.Total = msg.Progress.Current, msg.Progress.Total
+			}
+			progress(p)
+		}
+	}
+}
+
+// ensureImage pulls the image of the container according to its pull policy.
+func ensureImage(ctx context.Context, d Docker, opt CreateContainerOption) error {
+	switch opt.PullPolicy {
+	case PullIfNotPresent:
+		_, _, err := d.Client.ImageInspectWithRaw(ctx, opt.Config.Image)
+		if err == nil {
+			return nil
+		}
+		if !docker.IsErrNotFound(err) {
+			return &PhaseError{Phase: PhasePull, Err: err}
+		}
+	case PullAlways:
+	default:
+		return nil
+	}
+
+	auth := opt.RegistryAuth
+	if auth == nil && opt.Auth != nil {
+		var err error
+		auth, err = opt.Auth.ResolveAuth(registryHost(opt.Config.Image))
+		if err != nil {
+			return &PhaseError{Phase: PhasePull, Err: err}
+		}
+	}
+	return d.PullImage(ctx, opt.Config.Image, auth, opt.PullProgress)
+}
+
+// encodeAuth encodes the credentials the way the Docker API expects them in
+// the X-Registry-Auth header.
+func encodeAuth(auth types.AuthConfig) (string, error) {
+	b, err := json.Marshal(auth)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(b), nil
+}
+
+// withDefaultTag adds the "latest" tag to an image reference without a tag
+// or a digest, otherwise the engine pulls all tags of the repository.
+func withDefaultTag(ref string) string {
+	if strings.Contains(ref, "@") {
+		return ref
+	}
+	name := ref[strings.LastIndex(ref, "/")+1:]
+	if strings.Contains(name, ":") {
+		return ref
+	}
+	return ref + ":latest"
+}
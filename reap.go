@@ -0,0 +1,150 @@
+package dexec
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	types "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// Labels set on every container created by dexec, to find the containers left
+// behind by a process that exited before removing them.
+const (
+	// LabelManaged marks the containers created by dexec, with the value
+	// "true".
+	LabelManaged = "dexec.managed"
+
+	// LabelOwnerHost and LabelOwnerPID identify the process that created the
+	// container.
+	LabelOwnerHost = "dexec.owner.host"
+	LabelOwnerPID  = "dexec.owner.pid"
+
+	// LabelCreated is the time the container was created, in RFC 3339
+	// format.
+	LabelCreated = "dexec.created"
+
+	// LabelJobID is the CreateContainerOption.JobID of the container, if any.
+	LabelJobID = "dexec.job"
+)
+
+var ownerHost, _ = os.Hostname()
+
+// ownerLabels returns the labels of a container created by this process.
+func ownerLabels(jobID string) map[string]string {
+	labels := map[string]string{
+		LabelManaged:   "true",
+		LabelOwnerHost: ownerHost,
+		LabelOwnerPID:  strconv.Itoa(os.Getpid()),
+		LabelCreated:   time.Now().UTC().Format(time.RFC3339),
+	}
+	if jobID != "" {
+		labels[LabelJobID] = jobID
+	}
+	return labels
+}
+
+// withLabels returns a copy of labels with extra added.
+func withLabels(labels, extra map[string]string) map[string]string {
+	l := make(map[string]string, len(labels)+len(extra))
+	for k, v := range labels {
+		l[k] = v
+	}
+	for k, v := range extra {
+		l[k] = v
+	}
+	return l
+}
+
+// ReapFilter selects the containers removed by Reap. A container is removed
+// if it matches JobID and Labels, and either Orphans or MaxAge.
+type ReapFilter struct {
+	// Orphans selects the containers whose owner process is gone. Only the
+	// processes of this host can be checked, so the containers created on
+	// other hosts are selected only by MaxAge. Containers kept by a
+	// RetentionPolicy are left to SweepRetained.
+	Orphans bool
+
+	// MaxAge, if not zero, selects the containers created longer ago.
+	MaxAge time.Duration
+
+	// JobID, if not empty, restricts Reap to the containers of the job.
+	JobID string
+
+	// Labels, if not empty, restricts Reap to the containers with these
+	// labels.
+	Labels map[string]string
+}
+
+// Reap removes the containers created by dexec selected by the filter, such as
+// the ones left behind by a process that crashed while running commands, and
+// returns their IDs.
+func (d Docker) Reap(ctx context.Context, filter ReapFilter) ([]string, error) {
+	args := filters.NewArgs()
+	args.Add("label", LabelManaged+"=true")
+	if filter.JobID != "" {
+		args.Add("label", LabelJobID+"="+filter.JobID)
+	}
+	for k, v := range filter.Labels {
+		args.Add("label", k+"="+v)
+	}
+	containers, err := d.Client.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: args})
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for _, ctr := range containers {
+		if !filter.selects(ctr) {
+			continue
+		}
+		if err := d.ContainerRemove(ctx, ctr.ID, types.ContainerRemoveOptions{Force: true}); err != nil {
+			return removed, &PhaseError{Phase: PhaseRemove, ContainerID: ctr.ID, Err: err}
+		}
+		removed = append(removed, ctr.ID)
+	}
+	return removed, nil
+}
+
+func (f ReapFilter) selects(ctr types.Container) bool {
+	if f.MaxAge > 0 {
+		created, err := time.Parse(time.RFC3339, ctr.Labels[LabelCreated])
+		if err != nil {
+			created = time.Unix(ctr.Created, 0)
+		}
+		if time.Since(created) > f.MaxAge {
+			return true
+		}
+	}
+	if f.Orphans {
+		if _, retained := ctr.Labels[LabelRetentionTTL]; !retained {
+			return ownerGone(ctr.Labels)
+		}
+	}
+	return false
+}
+
+// ownerGone reports whether the process that created the container is known
+// to have exited.
+func ownerGone(labels map[string]string) bool {
+	if ownerHost == "" || labels[LabelOwnerHost] != ownerHost {
+		return false
+	}
+	pid, err := strconv.Atoi(labels[LabelOwnerPID])
+	if err != nil || pid <= 0 {
+		return false
+	}
+	if pid == os.Getpid() {
+		return false
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = p.Signal(syscall.Signal(0))
+	return errors.Is(err, os.ErrProcessDone) || errors.Is(err, syscall.ESRCH)
+}
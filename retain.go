@@ -0,0 +1,105 @@
+package dexec
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	types "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+)
+
+// RetentionPolicy determines whether the container of a command is kept after
+// the command exits, e.g. to inspect a failed environment with docker exec.
+type RetentionPolicy int
+
+const (
+	// RemoveAlways removes the container once the command exits.
+	RemoveAlways RetentionPolicy = iota
+
+	// KeepOnFailure keeps the container if the command does not exit
+	// successfully, or if it fails to start.
+	KeepOnFailure
+
+	// KeepAlways keeps the container regardless of the exit status.
+	KeepAlways
+)
+
+// DefaultRetentionTTL is the time a retained container is kept if
+// CreateContainerOption.RetentionTTL is zero.
+const DefaultRetentionTTL = 24 * time.Hour
+
+// LabelRetentionTTL is the label holding the number of seconds a retained
+// container is kept after it exits. Labels cannot be changed once the
+// container is created, so the expiry is derived from the time the container
+// exited, or was created if it never started.
+const LabelRetentionTTL = "dexec.retention-ttl"
+
+// retain reports whether the container must be kept, given whether the
+// command exited successfully.
+func (p RetentionPolicy) retain(success bool) bool {
+	switch p {
+	case KeepAlways:
+		return true
+	case KeepOnFailure:
+		return !success
+	}
+	return false
+}
+
+// SweepRetained removes the containers retained by a RetentionPolicy whose
+// retention expired, and returns their IDs.
+func (d Docker) SweepRetained(ctx context.Context) ([]string, error) {
+	args := filters.NewArgs()
+	args.Add("label", LabelManaged+"=true")
+	args.Add("label", LabelRetentionTTL)
+	containers, err := d.Client.ContainerList(ctx, types.ContainerListOptions{All: true, Filters: args})
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	now := time.Now()
+	for _, ctr := range containers {
+		if ctr.State == "running" || ctr.State == "paused" || ctr.State == "restarting" {
+			continue
+		}
+		secs, err := strconv.ParseInt(ctr.Labels[LabelRetentionTTL], 10, 64)
+		if err != nil {
+			continue // not ours to interpret
+		}
+		info, err := d.Client.ContainerInspect(ctx, ctr.ID)
+		if err != nil || info.ContainerJSONBase == nil || info.State == nil {
+			continue // removed meanwhile
+		}
+		since, err := time.Parse(time.RFC3339Nano, info.State.FinishedAt)
+		if err != nil || since.IsZero() {
+			since = time.Unix(ctr.Created, 0)
+		}
+		if now.Sub(since) < time.Duration(secs)*time.Second {
+			continue
+		}
+		if err := d.ContainerRemove(ctx, ctr.ID, types.ContainerRemoveOptions{Force: true}); err != nil {
+			return removed, &PhaseError{Phase: PhaseRemove, ContainerID: ctr.ID, Err: err}
+		}
+		removed = append(removed, ctr.ID)
+	}
+	return removed, nil
+}
+
+// RunSweeper calls SweepRetained every interval until ctx is done, reporting
+// its errors to onError if not nil.
+func (d Docker) RunSweeper(ctx context.Context, interval time.Duration, onError func(error)) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		if _, err := d.SweepRetained(ctx); err != nil && onError != nil && ctx.Err() == nil {
+			onError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
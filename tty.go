@@ -0,0 +1,40 @@
+package dexec
+
+import (
+	"context"
+
+	"github.com/docker/docker/api/types"
+)
+
+// Resizer is implemented by executions that can resize the terminal of a
+// command started with a TTY. Cmd uses it for Cmd.Resize.
+type Resizer interface {
+	Resize(ctx context.Context, d Docker, rows, cols uint) error
+}
+
+func (c *createContainer) Resize(ctx context.Context, d Docker, rows, cols uint) error {
+	if c.id == "" {
+		return ErrNotCreated
+	}
+	if err := d.Client.ContainerResize(ctx, c.id, types.ResizeOptions{Height: rows, Width: cols}); err != nil {
+		return &PhaseError{Phase: PhaseResize, ContainerID: c.id, Err: err}
+	}
+	return nil
+}
+
+func (e *execInContainer) Resize(ctx context.Context, d Docker, rows, cols uint) error {
+	if e.id == "" {
+		return ErrNotCreated
+	}
+	if err := d.Client.ContainerExecResize(ctx, e.id, types.ResizeOptions{Height: rows, Width: cols}); err != nil {
+		return &PhaseError{Phase: PhaseResize, ContainerID: e.container, Err: err}
+	}
+	return nil
+}
+
+func (e *pooledExecution) Resize(ctx context.Context, d Docker, rows, cols uint) error {
+	if e.exec == nil {
+		return ErrNotCreated
+	}
+	return e.exec.Resize(ctx, d, rows, cols)
+}